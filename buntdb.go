@@ -7,17 +7,21 @@ package buntdb
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tidwall/btree"
-	"github.com/tidwall/rtree"
 )
 
 var (
@@ -49,6 +53,37 @@ var (
 
 	// ErrShrinkInProcess is returned when a shrink operation is in-process.
 	ErrShrinkInProcess = errors.New("shrink is in-process")
+
+	// ErrConditionFailed is returned when the conditions of a Set() are not
+	// met, such as when the SetOptions.NX field is set and the key exists.
+	ErrConditionFailed = errors.New("condition failed")
+
+	// ErrNotNumber is returned when incrementing an item that has a value that
+	// is not a number. The returned error is a *NotNumberError which has the
+	// key and value, and matches ErrNotNumber with errors.Is().
+	ErrNotNumber = errors.New("value is not a number")
+
+	// ErrDatabaseLocked is returned when the database file is locked by
+	// another process.
+	ErrDatabaseLocked = errors.New("database locked")
+
+	// ErrFuncNotRegistered is returned when the database file references an
+	// index function that has not been registered with RegisterLess() or
+	// RegisterRect(). The returned error is a *FuncNotRegisteredError which
+	// names the function, and matches ErrFuncNotRegistered with errors.Is().
+	ErrFuncNotRegistered = errors.New("index function not registered")
+
+	// ErrInvalidEvictionPolicy is returned for an invalid EvictionPolicy
+	// value.
+	ErrInvalidEvictionPolicy = errors.New("invalid eviction policy")
+
+	// ErrOutOfMemory is returned by Set() when the item does not fit in the
+	// MaxMemory limit and no other item can be evicted.
+	ErrOutOfMemory = errors.New("out of memory")
+
+	// ErrCompacted is returned by ChangesSince() when the requested changes
+	// are no longer available, such as after a Shrink().
+	ErrCompacted = errors.New("changes compacted")
 )
 
 // Iterator allows callers of Ascend* or Descend* to iterate in-order
@@ -62,6 +97,7 @@ type Iterator func(key, val string) bool
 type DB struct {
 	mu        sync.RWMutex      // the gatekeeper for all fields
 	file      *os.File          // the underlying file
+	path      string            // the path of the underlying file
 	bufw      *bufio.Writer     // only write to this
 	keys      *btree.BTree      // a tree of all item ordered by key
 	exps      *btree.BTree      // a tree of items ordered by expiration
@@ -73,6 +109,24 @@ type DB struct {
 	persist   bool              // do we write to disk
 	shrinking bool              // when an aof shrink is in-process.
 	lastaofsz int               // the size of the last shrink aof size
+	tailpos   int64             // the read position of a read-only file
+	touchmu   sync.Mutex        // guards the touches field
+	touches   map[string]bool   // sliding items read since the last refresh
+	memsize   int64             // the approximate memory used by the items
+	evictpvt  *dbItem           // where the next eviction sample begins
+	watchmu   sync.Mutex        // guards the watchers field
+	watchers  map[*watcher]bool // the channels returned by Watch()
+	seq       uint64            // the sequence of the last committed tx
+	seqbase   uint64            // the file has the changes after this seq
+	ring      []Change          // the most recent changes
+	commitc   chan struct{}     // closed when the seq changes
+	replica   *replica          // set while following a leader
+	snapmu    sync.RWMutex      // guards the snap field
+	snap      *snapshot         // what read-only transactions see
+
+	// skipped has the definitions of the indexes that were not created
+	// because of SkipUnregisteredIndexes, by index name.
+	skipped map[string][]string
 }
 
 // SyncPolicy represents how often data is synced to disk.
@@ -92,6 +146,25 @@ const (
 	Always = 2
 )
 
+// EvictionPolicy represents which items are evicted when the database
+// reaches the MaxMemory limit.
+type EvictionPolicy int
+
+const (
+	// NoEviction is used to disable evictions. A Set() that does not fit
+	// in memory fails with ErrOutOfMemory.
+	NoEviction EvictionPolicy = 0
+	// AllKeysLRU evicts the least recently used items.
+	AllKeysLRU = 1
+	// VolatileLRU evicts the least recently used items that have an
+	// expiration.
+	VolatileLRU = 2
+	// AllKeysLFU evicts the least frequently used items.
+	AllKeysLFU = 3
+	// VolatileTTL evicts the items that are closest to expiring.
+	VolatileTTL = 4
+)
+
 // Config represents database configuration options. These
 // options are used to change various behaviors of the database.
 type Config struct {
@@ -114,6 +187,98 @@ type Config struct {
 
 	// AutoShrinkDisabled turns off automatic background shrinking
 	AutoShrinkDisabled bool
+
+	// FileMode is the permission bits that are used when the database file
+	// is created. The default is 0666.
+	// This value is only used by OpenWithConfig().
+	FileMode os.FileMode
+
+	// ReadOnly opens the database file without write access. Read/write
+	// transactions fail with ErrTxNotWritable and the background process
+	// that removes expired items and shrinks the file is not started.
+	// This value is only used by OpenWithConfig().
+	ReadOnly bool
+
+	// Tail is used with ReadOnly to keep the database current with the
+	// changes that another process appends to the database file. The file
+	// is checked for new records every BackgroundInterval.
+	// This value is only used by OpenWithConfig().
+	Tail bool
+
+	// SharedLock is used with ReadOnly to take a shared lock on the database
+	// file. A shared lock prevents a writer process from opening the file,
+	// but allows for other read-only processes that also use a shared lock.
+	// By default a read-only database does not lock the file, while a
+	// writable database always takes an exclusive lock.
+	// This value is only used by OpenWithConfig().
+	SharedLock bool
+
+	// SkipUnregisteredIndexes is used with ReadOnly to load a database file
+	// that defines indexes with functions that have not been registered,
+	// such as by a tool that inspects the file. Those indexes are not
+	// created, instead of failing with ErrFuncNotRegistered, and their
+	// definitions are kept in a snapshot from Save().
+	// This value is only used by OpenWithConfig().
+	SkipUnregisteredIndexes bool
+
+	// BTreeDegree is the degree of the b-trees that hold the keys and the
+	// indexes. Values less than 2 are ignored. The default is 16.
+	// This value is only used by OpenWithConfig().
+	BTreeDegree int
+
+	// BackgroundInterval is how often the background process runs. Values
+	// less than or equal to zero are ignored. The default is one second.
+	// This value is only used by OpenWithConfig().
+	BackgroundInterval time.Duration
+
+	// OnExpired is called by the background process for every item that has
+	// expired and was removed from the database. It's called after the
+	// removal has been committed and outside of the database lock, thus it's
+	// safe to open new transactions from within the function.
+	OnExpired func(key, val string)
+
+	// OnExpiredSync is called by the background process for every item that
+	// has expired, from within the transaction that removes the items. The
+	// function may veto or extend the expiration by setting the item again
+	// using the tx param, such as with a new TTL. Otherwise the item is
+	// deleted. Returning an error rolls back the transaction and leaves all
+	// expired items in the database until the next run. Opening another
+	// transaction from within this function will cause a deadlock.
+	OnExpiredSync func(key, val string, tx *Tx) error
+
+	// Checksum adds a CRC-32 checksum to every transaction that is written to
+	// the aof file. When the database is loaded, a transaction that does not
+	// match its checksum is treated as invalid, and a partially written
+	// transaction is never applied. See Recover() for repairing a database
+	// file that failed to load.
+	Checksum bool
+
+	// AutoRecover repairs the database file when the database is opened, like
+	// Recover() does, instead of failing to open a file that has a corrupted
+	// transaction. The file is read one more time to find the last valid
+	// transaction. It has no effect on a read-only database.
+	AutoRecover bool
+
+	// OnRecover is called by AutoRecover with the number of bytes that were
+	// discarded from the end of the database file.
+	OnRecover func(discarded int64)
+
+	// MaxMemory is the approximate number of bytes that the keys, values and
+	// index entries may use. When a Set() goes over the limit, items are
+	// evicted based on the EvictionPolicy. Zero means that there's no limit.
+	MaxMemory int64
+
+	// EvictionPolicy selects the items that are evicted when the MaxMemory
+	// limit is reached. This value can be NoEviction, AllKeysLRU,
+	// VolatileLRU, AllKeysLFU, or VolatileTTL. The default is NoEviction.
+	EvictionPolicy EvictionPolicy
+
+	// ChangeRingSize is the number of the most recent changes that are kept
+	// in memory for ChangesSince(). Older changes are read from the database
+	// file. Values less than or equal to zero are ignored. The default is
+	// 4096.
+	// This value is only used by OpenWithConfig().
+	ChangeRingSize int
 }
 
 // exctx is a simple b-tree context for ordering by expiration.
@@ -121,37 +286,145 @@ type exctx struct {
 	db *DB
 }
 
+// DefaultConfig returns the database configuration that is used by Open().
+// It's intended to be a starting point for the config that is passed to
+// OpenWithConfig().
+func DefaultConfig() Config {
+	return Config{
+		SyncPolicy:           EverySecond,
+		AutoShrinkPercentage: 100,
+		AutoShrinkMinSize:    32 * 1024 * 1024,
+		FileMode:             0666,
+		BTreeDegree:          16,
+		BackgroundInterval:   time.Second,
+		ChangeRingSize:       4096,
+	}
+}
+
 // Open opens a database at the provided path.
 // If the file does not exist then it will be created automatically.
 func Open(path string) (*DB, error) {
+	return OpenWithConfig(path, DefaultConfig())
+}
+
+// OpenWithConfig opens a database at the provided path using the provided
+// configuration. The configuration is applied before the database file is
+// loaded. If the file does not exist then it will be created automatically,
+// unless the ReadOnly option is set.
+func OpenWithConfig(path string, config Config) (*DB, error) {
+	switch config.SyncPolicy {
+	default:
+		return nil, ErrInvalidSyncPolicy
+	case Never, EverySecond, Always:
+	}
+	switch config.EvictionPolicy {
+	default:
+		return nil, ErrInvalidEvictionPolicy
+	case NoEviction, AllKeysLRU, VolatileLRU, AllKeysLFU, VolatileTTL:
+	}
+	def := DefaultConfig()
+	if config.FileMode == 0 {
+		config.FileMode = def.FileMode
+	}
+	if config.BTreeDegree < 2 {
+		config.BTreeDegree = def.BTreeDegree
+	}
+	if config.BackgroundInterval <= 0 {
+		config.BackgroundInterval = def.BackgroundInterval
+	}
+	if config.ChangeRingSize <= 0 {
+		config.ChangeRingSize = def.ChangeRingSize
+	}
 	db := &DB{}
-	db.keys = btree.New(16, nil)
-	db.exps = btree.New(16, &exctx{db})
+	db.keys = btree.New(config.BTreeDegree, nil)
+	db.exps = btree.New(config.BTreeDegree, &exctx{db})
 	db.idxs = make(map[string]*index)
-	db.config = Config{
-		SyncPolicy:           EverySecond,
-		AutoShrinkPercentage: 100,
-		AutoShrinkMinSize:    32 * 1024 * 1024,
-	}
+	db.commitc = make(chan struct{})
+	db.config = config
 	db.persist = path != ":memory:"
 	if db.persist {
 		var err error
-		// Hardcoding 0666 as the default mode.
-		db.file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+		db.path = path
+		db.file, err = openFile(path, config)
 		if err != nil {
 			return nil, err
 		}
+		if config.AutoRecover && !config.ReadOnly {
+			discarded, err := recoverFile(db.file)
+			if err != nil {
+				_ = db.file.Close()
+				return nil, err
+			}
+			if discarded > 0 && config.OnRecover != nil {
+				config.OnRecover(discarded)
+			}
+		}
 		if err := db.load(); err != nil {
 			_ = db.file.Close()
 			return nil, err
 		}
 		db.bufw = bufio.NewWriter(db.file)
 	}
-	// start the background manager.
-	go db.backgroundManager()
+	db.publish()
+	if !config.ReadOnly {
+		// start the background manager.
+		go db.backgroundManager(config.BackgroundInterval)
+	} else if config.Tail && db.persist {
+		// start following the file.
+		go db.tailManager(config.BackgroundInterval)
+	}
 	return db, nil
 }
 
+// openFile opens and locks the database file. Another process may replace the
+// file, such as with a Shrink(), after it's opened and before it's locked. The
+// lock would then be on the previous file, thus the new file is opened again.
+func openFile(path string, config Config) (*os.File, error) {
+	for {
+		var f *os.File
+		var err error
+		if config.ReadOnly {
+			f, err = os.OpenFile(path, os.O_RDONLY, 0)
+		} else {
+			f, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, config.FileMode)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if config.ReadOnly && !config.SharedLock {
+			return f, nil
+		}
+		if err := lockFile(f, config.ReadOnly); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		pfi, err := os.Stat(path)
+		if err == nil && os.SameFile(fi, pfi) {
+			return f, nil
+		}
+		_ = f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// OpenReadOnly opens an existing database at the provided path without write
+// access. The file may be shared with another process that has the database
+// opened for writing, but changes made by that process after the file is
+// loaded are not seen. Use OpenWithConfig() with the ReadOnly and Tail options
+// to follow those changes.
+func OpenReadOnly(path string) (*DB, error) {
+	config := DefaultConfig()
+	config.ReadOnly = true
+	return OpenWithConfig(path, config)
+}
+
 // Close releases all database resources.
 // All transactions must be closed before closing the database.
 func (db *DB) Close() error {
@@ -161,6 +434,20 @@ func (db *DB) Close() error {
 		return ErrDatabaseClosed
 	}
 	db.closed = true
+	close(db.commitc)
+	db.snapmu.Lock()
+	db.snap = nil
+	db.snapmu.Unlock()
+	if db.replica != nil {
+		// Stop reading from the leader.
+		_ = db.replica.conn.Close()
+	}
+	db.watchmu.Lock()
+	for w := range db.watchers {
+		close(w.ch)
+	}
+	db.watchers = nil
+	db.watchmu.Unlock()
 	if db.persist {
 		if err := db.file.Close(); err != nil {
 			return err
@@ -176,18 +463,181 @@ func (db *DB) Close() error {
 // b-tree/r-tree context for itself.
 type index struct {
 	btr     *btree.BTree                           // contains the items
-	rtr     *rtree.RTree                           // contains the items
+	rtr     *rtree                                 // contains the items
 	name    string                                 // name of the index
 	pattern string                                 // a required key pattern
 	less    func(a, b string) bool                 // less comparison function
 	rect    func(item string) (min, max []float64) // rect from string function
+	fname   string                                 // registered function name
 	db      *DB                                    // the origin database
+	snap    *index                                 // the copy in the last snapshot
+	dirty   bool                                   // changed since the last snapshot
+}
+
+// snapshot is an immutable copy of the items and indexes of the database. The
+// trees are copy-on-write clones, thus a snapshot is cheap to create and is
+// not affected by later changes to the database. Read-only transactions read
+// the most recent snapshot without locking the database.
+type snapshot struct {
+	keys    *btree.BTree      // the items ordered by key
+	idxs    map[string]*index // the copies of the indexes
+	skipped [][]string        // the definitions of unregistered indexes
+	config  Config            // the database configuration
+	seq     uint64            // the sequence of the last committed tx
+}
+
+// publish makes the current items and indexes visible to read-only
+// transactions. It must be called with the write lock held after the database
+// has changed.
+func (db *DB) publish() {
+	snap := &snapshot{
+		keys:   db.keys.Clone(),
+		idxs:   make(map[string]*index, len(db.idxs)),
+		config: db.config,
+		seq:    db.seq,
+	}
+	for name, idx := range db.idxs {
+		snap.idxs[name] = idx.snapshot()
+	}
+	for _, parts := range db.skipped {
+		snap.skipped = append(snap.skipped, parts)
+	}
+	db.snapmu.Lock()
+	db.snap = snap
+	db.snapmu.Unlock()
+}
+
+// snapshot returns a copy of the index for a snapshot. The copy in the
+// previous snapshot is reused when the index has not changed.
+func (idx *index) snapshot() *index {
+	if idx.snap != nil && !idx.dirty {
+		return idx.snap
+	}
+	snap := &index{
+		name:    idx.name,
+		pattern: idx.pattern,
+		less:    idx.less,
+		rect:    idx.rect,
+		fname:   idx.fname,
+		db:      idx.db,
+	}
+	if idx.btr != nil {
+		snap.btr = idx.btr.Clone()
+	}
+	if idx.rtr != nil {
+		snap.rtr = idx.rtr.Clone()
+	}
+	idx.snap, idx.dirty = snap, false
+	return snap
+}
+
+// funcs is the registry of named less and rect functions. It allows for
+// index definitions to be written to and read from the aof file.
+var funcs = struct {
+	mu        sync.RWMutex
+	less      map[string]func(a, b string) bool
+	rect      map[string]func(item string) (min, max []float64)
+	lessNames map[uintptr]string
+	rectNames map[uintptr]string
+}{
+	less:      make(map[string]func(a, b string) bool),
+	rect:      make(map[string]func(item string) (min, max []float64)),
+	lessNames: make(map[uintptr]string),
+	rectNames: make(map[uintptr]string),
+}
+
+func init() {
+	RegisterLess("IndexString", IndexString)
+	RegisterLess("IndexBinary", IndexBinary)
+	RegisterLess("IndexInt", IndexInt)
+	RegisterLess("IndexUint", IndexUint)
+	RegisterLess("IndexFloat", IndexFloat)
+	RegisterRect("IndexRect", IndexRect)
+}
+
+// NotNumberError is returned by Incr() and IncrFloat() when the value of the
+// item is not a number.
+type NotNumberError struct {
+	Key   string // the key of the item
+	Value string // the value that is not a number
+}
+
+func (e *NotNumberError) Error() string {
+	return ErrNotNumber.Error() + ": " + strconv.Quote(e.Key)
+}
+
+// Is returns true when target is ErrNotNumber.
+func (e *NotNumberError) Is(target error) bool {
+	return target == ErrNotNumber
+}
+
+// FuncNotRegisteredError is returned when the database file references an
+// index function that has not been registered.
+type FuncNotRegisteredError struct {
+	Name string // the name of the function in the database file
+}
+
+func (e *FuncNotRegisteredError) Error() string {
+	return ErrFuncNotRegistered.Error() + ": " + e.Name
+}
+
+// Is returns true when target is ErrFuncNotRegistered.
+func (e *FuncNotRegisteredError) Is(target error) bool {
+	return target == ErrFuncNotRegistered
+}
+
+// RegisterLess registers a less function by name. Indexes that are created
+// with a registered less function are persisted to the database file and are
+// automatically rebuilt when the database is opened again.
+//
+// Functions are matched by identity, therefore only top-level functions
+// should be registered, and not closures. A process that opens a database
+// file must register the same functions, using the same names, before
+// calling Open().
+//
+// The built-in IndexString, IndexBinary, IndexInt, IndexUint, and IndexFloat
+// functions are registered by default using their function names.
+func RegisterLess(name string, less func(a, b string) bool) {
+	funcs.mu.Lock()
+	defer funcs.mu.Unlock()
+	funcs.less[name] = less
+	funcs.lessNames[reflect.ValueOf(less).Pointer()] = name
+}
+
+// RegisterRect registers a rect function by name. Spatial indexes that are
+// created with a registered rect function are persisted to the database file
+// and are automatically rebuilt when the database is opened again.
+//
+// The same rules that apply to RegisterLess() apply here. The built-in
+// IndexRect function is registered by default.
+func RegisterRect(name string, rect func(item string) (min, max []float64)) {
+	funcs.mu.Lock()
+	defer funcs.mu.Unlock()
+	funcs.rect[name] = rect
+	funcs.rectNames[reflect.ValueOf(rect).Pointer()] = name
+}
+
+// funcName returns the registered name of the less or rect function. An empty
+// string is returned when the function has not been registered.
+func funcName(less func(a, b string) bool,
+	rect func(item string) (min, max []float64)) string {
+	funcs.mu.RLock()
+	defer funcs.mu.RUnlock()
+	if less != nil {
+		return funcs.lessNames[reflect.ValueOf(less).Pointer()]
+	}
+	if rect != nil {
+		return funcs.rectNames[reflect.ValueOf(rect).Pointer()]
+	}
+	return ""
 }
 
 // CreateIndex builds a new index and populates it with items.
 // The items are ordered in an b-tree and can be retrieved using the
 // Ascend* and Descend* methods.
-// An error will occur if an index with the same name already exists.
+// An error will occur if an index with the same name already exists, unless
+// it's the same persisted index, such as an index that was rebuilt when the
+// database was opened, in which case nothing happens.
 //
 // When a pattern is provided, the index will be populated with
 // keys that match the specified pattern.
@@ -197,6 +647,10 @@ type index struct {
 // less function to handle the content format and comparison.
 // There are some default less function that can be used such as
 // IndexString, IndexBinary, etc.
+//
+// When the less function has been registered with RegisterLess(), the index
+// definition is also written to the database file and the index will be
+// rebuilt when the database is opened again.
 func (db *DB) CreateIndex(name, pattern string,
 	less func(a, b string) bool) error {
 	return db.createIndex(name, pattern, less, nil)
@@ -205,7 +659,9 @@ func (db *DB) CreateIndex(name, pattern string,
 // CreateSpatialIndex builds a new index and populates it with items.
 // The items are organized in an r-tree and can be retrieved using the
 // Intersects method.
-// An error will occur if an index with the same name already exists.
+// An error will occur if an index with the same name already exists, unless
+// it's the same persisted index, such as an index that was rebuilt when the
+// database was opened, in which case nothing happens.
 //
 // The rect function converts a string to a rectangle. The rectangle is
 // represented by two arrays, min and max. Both arrays may have a length
@@ -216,6 +672,10 @@ func (db *DB) CreateIndex(name, pattern string,
 // Thus min[0] must be less-than-or-equal-to max[0].
 // The IndexRect is a default function that can be used for the rect
 // parameter.
+//
+// When the rect function has been registered with RegisterRect(), the index
+// definition is also written to the database file and the index will be
+// rebuilt when the database is opened again.
 func (db *DB) CreateSpatialIndex(name, pattern string,
 	rect func(item string) (min, max []float64)) error {
 	return db.createIndex(name, pattern, nil, rect)
@@ -236,7 +696,13 @@ func (db *DB) createIndex(
 	if name == "" {
 		return ErrIndexExists
 	}
-	if _, ok := db.idxs[name]; ok {
+	fname := funcName(less, rect)
+	if idx, ok := db.idxs[name]; ok {
+		if fname != "" && idx.fname == fname && idx.pattern == pattern &&
+			(idx.less != nil) == (less != nil) {
+			// The same persisted index already exists.
+			return nil
+		}
 		return ErrIndexExists
 	}
 	idx := &index{
@@ -244,13 +710,34 @@ func (db *DB) createIndex(
 		pattern: pattern,
 		less:    less,
 		rect:    rect,
+		fname:   fname,
 		db:      db,
 	}
+	if db.persist && !db.config.ReadOnly && idx.fname != "" {
+		// The index function is registered. Write the index definition to
+		// disk so that it can be rebuilt when the database is reopened.
+		idx.writeCreateTo(db.bufw)
+		if err := db.flush(); err != nil {
+			return err
+		}
+	}
+	db.buildIndex(idx)
+	db.publish()
+	return nil
+}
+
+// buildIndex populates the index with the matching items and adds it to the
+// database, replacing an index with the same name.
+func (db *DB) buildIndex(idx *index) {
+	if prev, ok := db.idxs[idx.name]; ok {
+		db.removeIndex(prev)
+	}
+	less, rect := idx.less, idx.rect
 	if less != nil {
-		idx.btr = btree.New(16, idx)
+		idx.btr = btree.New(db.config.BTreeDegree, idx)
 	}
 	if rect != nil {
-		idx.rtr = rtree.New(idx)
+		idx.rtr = newRTree(idx)
 	}
 	db.keys.Ascend(func(item btree.Item) bool {
 		dbi := item.(*dbItem)
@@ -263,9 +750,63 @@ func (db *DB) createIndex(
 		if rect != nil {
 			idx.rtr.Insert(dbi)
 		}
+		dbi.idxn++
+		db.memsize += indexOverhead
+		return true
+	})
+	idx.dirty = true
+	db.idxs[idx.name] = idx
+}
+
+// removeIndex removes the index from the database, along with the memory that
+// is used by its entries.
+func (db *DB) removeIndex(idx *index) {
+	delete(db.idxs, idx.name)
+	db.keys.Ascend(func(item btree.Item) bool {
+		dbi := item.(*dbItem)
+		if wildcardMatch(dbi.key, idx.pattern) {
+			dbi.idxn--
+			db.memsize -= indexOverhead
+		}
 		return true
 	})
-	db.idxs[name] = idx
+}
+
+// writeTx writes the records produced by fn to the aof as a single
+// transaction, and flushes the buffer to disk. The records are wrapped in
+// MULTI and EXEC so that a partially written transaction is never loaded.
+func (db *DB) writeTx(fn func(wr *bufio.Writer)) error {
+	wr := db.bufw
+	var buf bytes.Buffer
+	if db.config.Checksum {
+		// The records are first written to a temporary buffer which
+		// is used to generate the checksum.
+		wr = bufio.NewWriter(&buf)
+	}
+	writeMultiBulk(wr, "multi")
+	fn(wr)
+	writeMultiBulk(wr, "exec")
+	if db.config.Checksum {
+		_ = wr.Flush()
+		writeMultiBulk(db.bufw, "checksum",
+			strconv.FormatUint(uint64(crc32.ChecksumIEEE(buf.Bytes())), 10),
+			strconv.FormatInt(int64(buf.Len()), 10))
+		_, _ = db.bufw.Write(buf.Bytes())
+	}
+	// Flushing the buffer only once per transaction.
+	return db.flush()
+}
+
+// flush writes the buffered aof records to disk.
+func (db *DB) flush() error {
+	if err := db.bufw.Flush(); err != nil {
+		return err
+	}
+	if db.config.SyncPolicy == Always {
+		_ = db.file.Sync()
+	}
+	// Increment the number of flushes. The background syncing uses this.
+	db.flushes++
 	return nil
 }
 
@@ -309,10 +850,18 @@ func (db *DB) DropIndex(name string) error {
 	if name == "" {
 		return ErrInvalidOperation
 	}
-	if _, ok := db.idxs[name]; !ok {
+	idx, ok := db.idxs[name]
+	if !ok {
 		return ErrNotFound
 	}
-	delete(db.idxs, name)
+	if db.persist && !db.config.ReadOnly && idx.fname != "" {
+		idx.writeDropTo(db.bufw)
+		if err := db.flush(); err != nil {
+			return err
+		}
+	}
+	db.removeIndex(idx)
+	db.publish()
 	return nil
 }
 
@@ -343,6 +892,9 @@ func (db *DB) ReadConfig(config *Config) error {
 }
 
 // SetConfig updates the database configuration.
+// The FileMode, ReadOnly, Tail, SharedLock, BTreeDegree, BackgroundInterval,
+// and ChangeRingSize options can only be set when the database is opened, and
+// are ignored by this function.
 func (db *DB) SetConfig(config Config) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
@@ -354,7 +906,21 @@ func (db *DB) SetConfig(config Config) error {
 		return ErrInvalidSyncPolicy
 	case Never, EverySecond, Always:
 	}
+	switch config.EvictionPolicy {
+	default:
+		return ErrInvalidEvictionPolicy
+	case NoEviction, AllKeysLRU, VolatileLRU, AllKeysLFU, VolatileTTL:
+	}
+	config.FileMode = db.config.FileMode
+	config.ReadOnly = db.config.ReadOnly
+	config.Tail = db.config.Tail
+	config.SharedLock = db.config.SharedLock
+	config.SkipUnregisteredIndexes = db.config.SkipUnregisteredIndexes
+	config.BTreeDegree = db.config.BTreeDegree
+	config.BackgroundInterval = db.config.BackgroundInterval
+	config.ChangeRingSize = db.config.ChangeRingSize
 	db.config = config
+	db.publish()
 	return nil
 }
 
@@ -368,11 +934,15 @@ func (db *DB) insertIntoDatabase(item *dbItem) *dbItem {
 		// A previous item was removed from the keys tree. Let's
 		// fully delete this item from all indexes.
 		pdbi = prev.(*dbItem)
+		db.memsize -= itemSize(pdbi)
 		if pdbi.opts != nil && pdbi.opts.ex {
 			// Remove it from the exipres tree.
 			db.exps.Delete(pdbi)
 		}
 		for _, idx := range db.idxs {
+			if !wildcardMatch(pdbi.key, idx.pattern) {
+				continue
+			}
 			if idx.btr != nil {
 				// Remove it from the btree index.
 				idx.btr.Delete(pdbi)
@@ -381,13 +951,18 @@ func (db *DB) insertIntoDatabase(item *dbItem) *dbItem {
 				// Remove it from the rtree index.
 				idx.rtr.Remove(pdbi)
 			}
+			idx.dirty = true
 		}
 	}
+	if db.config.MaxMemory > 0 {
+		atomic.StoreInt64(&item.atime, time.Now().UnixNano())
+	}
 	if item.opts != nil && item.opts.ex {
 		// The new item has eviction options. Add it to the
 		// expires tree
 		db.exps.ReplaceOrInsert(item)
 	}
+	item.idxn = 0
 	for _, idx := range db.idxs {
 		if !wildcardMatch(item.key, idx.pattern) {
 			continue
@@ -400,7 +975,10 @@ func (db *DB) insertIntoDatabase(item *dbItem) *dbItem {
 			// Add new item to rtree index.
 			idx.rtr.Insert(item)
 		}
+		idx.dirty = true
+		item.idxn++
 	}
+	db.memsize += itemSize(item)
 	// we must return the previous item to the caller.
 	return pdbi
 }
@@ -416,11 +994,15 @@ func (db *DB) deleteFromDatabase(item *dbItem) *dbItem {
 	prev := db.keys.Delete(item)
 	if prev != nil {
 		pdbi = prev.(*dbItem)
+		db.memsize -= itemSize(pdbi)
 		if pdbi.opts != nil && pdbi.opts.ex {
 			// Remove it from the exipres tree.
 			db.exps.Delete(pdbi)
 		}
 		for _, idx := range db.idxs {
+			if !wildcardMatch(pdbi.key, idx.pattern) {
+				continue
+			}
 			if idx.btr != nil {
 				// Remove it from the btree index.
 				idx.btr.Delete(pdbi)
@@ -429,129 +1011,773 @@ func (db *DB) deleteFromDatabase(item *dbItem) *dbItem {
 				// Remove it from the rtree index.
 				idx.rtr.Remove(pdbi)
 			}
+			idx.dirty = true
 		}
 	}
 	return pdbi
 }
 
-// backgroundManager runs continuously in the background and performs various
-// operations such as removing expired items and syncing to disk.
-func (db *DB) backgroundManager() {
-	flushes := 0
-	t := time.NewTicker(time.Second)
-	defer t.Stop()
-	for range t.C {
-		var shrink bool
-		// Open a standard view. This will take a full lock of the
-		// database thus allowing for access to anything we need.
-		err := db.Update(func(tx *Tx) error {
-			if db.persist && !db.config.AutoShrinkDisabled {
-				pos, err := db.file.Seek(0, 1)
-				if err != nil {
-					return err
-				}
-				aofsz := int(pos)
-				if aofsz > db.config.AutoShrinkMinSize {
-					perc := float64(db.config.AutoShrinkPercentage) / 100.0
-					shrink = aofsz > db.lastaofsz+int(float64(db.lastaofsz)*perc)
-				}
-			}
-			// produce a list of expired items that need removing
-			var remove []*dbItem
-			db.exps.AscendLessThan(&dbItem{
-				opts: &dbItemOpts{ex: true, exat: time.Now()},
-			}, func(item btree.Item) bool {
-				remove = append(remove, item.(*dbItem))
-				return true
-			})
-			for _, item := range remove {
-				if _, err := tx.Delete(item.key); err != nil {
-					// it's ok to get a "not found" because the
-					// 'Delete' method reports "not found" for
-					// expired items.
-					if err != ErrNotFound {
-						return err
-					}
-				}
-			}
+// EventType is the type of change that an Event represents.
+type EventType int
 
-			// execute a disk sync.
-			if db.persist && db.config.SyncPolicy == EverySecond &&
-				flushes != db.flushes {
-				_ = db.file.Sync()
-				flushes = db.flushes
+const (
+	// EventSet is sent when an item is inserted or replaced, including
+	// when only its expiration has changed.
+	EventSet EventType = 0
+	// EventDelete is sent when an item is deleted.
+	EventDelete = 1
+	// EventExpire is sent when an item that has expired is removed.
+	EventExpire = 2
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	}
+	return "unknown"
+}
+
+// Event represents a change to an item that has been committed.
+type Event struct {
+	// Type is the kind of change.
+	Type EventType
+	// Key is the key of the item.
+	Key string
+	// Old is the value before the transaction. It's empty when the item did
+	// not exist.
+	Old string
+	// New is the value after the transaction. It's empty for EventDelete
+	// and EventExpire.
+	New string
+}
+
+// WatchBufferSize is the number of events that are buffered for each channel
+// returned by Watch().
+const WatchBufferSize = 1024
+
+// watcher is a channel that receives events for the keys matching a pattern.
+type watcher struct {
+	pattern string
+	ch      chan Event
+}
+
+// Watch returns a channel that receives an Event for every change of an item
+// with a key matching the pattern, after the change has been committed. The
+// pattern uses the same syntax as the index patterns, where '*' matches on any
+// number of characters and '?' matches on any one character. Events are sent
+// in commit order. The changes of a single transaction are sorted by key.
+//
+// Each channel buffers up to WatchBufferSize events. A consumer that falls
+// further behind is dropped: its channel is closed without delivering the
+// event that did not fit, and the consumer should reload the keys it's
+// interested in before watching again. Committing transactions never block
+// on slow consumers.
+//
+// The channel is also closed when the cancel function is called or when the
+// database is closed.
+func (db *DB) Watch(pattern string) (events <-chan Event, cancel func()) {
+	w := &watcher{pattern: pattern, ch: make(chan Event, WatchBufferSize)}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		close(w.ch)
+		return w.ch, func() {}
+	}
+	db.watchmu.Lock()
+	if db.watchers == nil {
+		db.watchers = make(map[*watcher]bool)
+	}
+	db.watchers[w] = true
+	db.watchmu.Unlock()
+	return w.ch, func() {
+		db.watchmu.Lock()
+		if db.watchers[w] {
+			delete(db.watchers, w)
+			close(w.ch)
+		}
+		db.watchmu.Unlock()
+	}
+}
+
+// notify sends the changes of a committed transaction to the watchers.
+func (db *DB) notify(tx *Tx) {
+	db.watchmu.Lock()
+	defer db.watchmu.Unlock()
+	if len(db.watchers) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(tx.rollbacks))
+	for key := range tx.rollbacks {
+		if !tx.refreshes[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		old, cur := tx.rollbacks[key], db.get(key)
+		var ev Event
+		switch {
+		case cur == old:
+			// Such as inserted and deleted by the same transaction.
+			continue
+		case cur == nil && old.expired():
+			ev = Event{Type: EventExpire, Key: key, Old: old.val}
+		case cur == nil:
+			ev = Event{Type: EventDelete, Key: key, Old: old.val}
+		default:
+			ev = Event{Type: EventSet, Key: key, New: cur.val}
+			if old != nil && !old.expired() {
+				ev.Old = old.val
 			}
-			return nil
-		})
-		if err == ErrDatabaseClosed {
-			break
 		}
-		if shrink {
-			if err = db.Shrink(); err != nil {
-				if err == ErrDatabaseClosed {
-					break
-				}
+		for w := range db.watchers {
+			if !wildcardMatch(key, w.pattern) {
+				continue
+			}
+			select {
+			case w.ch <- ev:
+			default:
+				// The consumer is too slow.
+				delete(db.watchers, w)
+				close(w.ch)
 			}
 		}
 	}
 }
 
-// Shrink will make the database file smaller by removing redundant
-// log entries. This operation does not block the database.
-func (db *DB) Shrink() error {
-	db.mu.Lock()
-	if db.closed {
-		db.mu.Unlock()
-		return ErrDatabaseClosed
+// ChangeType is the type of change that a Change represents.
+type ChangeType int
+
+const (
+	// ChangeSet is an item that was inserted or replaced.
+	ChangeSet ChangeType = 0
+	// ChangeDelete is an item that was deleted.
+	ChangeDelete = 1
+	// ChangeTTL is an item that only had its expiration changed. The Value
+	// of the change is empty.
+	ChangeTTL = 2
+)
+
+// Change represents a change to an item that was made by a committed
+// transaction.
+type Change struct {
+	// Seq is the sequence number of the transaction.
+	Seq uint64
+	// Type is the kind of change.
+	Type ChangeType
+	// Key is the key of the item.
+	Key string
+	// Value is the new value of the item. It's empty for ChangeDelete and
+	// ChangeTTL.
+	Value string
+	// ExpiresAt is when the item expires. It's zero when the item does not
+	// expire.
+	ExpiresAt time.Time
+	// TTL is the sliding time-to-live of the item, which extends ExpiresAt
+	// each time the item is read. It's zero when the expiration is not
+	// sliding.
+	TTL time.Duration
+}
+
+// newChange returns the change that sets or deletes an item.
+func newChange(seq uint64, key string, item *dbItem, ttl bool) Change {
+	c := Change{Seq: seq, Key: key}
+	switch {
+	case item == nil:
+		c.Type = ChangeDelete
+		return c
+	case ttl:
+		c.Type = ChangeTTL
+	default:
+		c.Type = ChangeSet
+		c.Value = item.val
 	}
-	if !db.persist {
-		// The database was opened with ":memory:" as the path.
-		// There is no persistence, and no need to do anything here.
-		db.mu.Unlock()
-		return nil
+	if item.opts != nil && item.opts.ex {
+		c.ExpiresAt = item.opts.deadline()
+		c.TTL = item.opts.ttl
 	}
-	if db.shrinking {
-		// The database is already in the process of shrinking.
-		db.mu.Unlock()
-		return ErrShrinkInProcess
+	return c
+}
+
+// changeItem returns the item of a change.
+func changeItem(c Change) *dbItem {
+	item := &dbItem{key: c.Key, val: c.Value}
+	if !c.ExpiresAt.IsZero() {
+		item.opts = &dbItemOpts{ex: true, exat: c.ExpiresAt}
+		if c.TTL > 0 {
+			item.opts.ttl = c.TTL
+		}
 	}
-	db.shrinking = true
-	defer func() {
-		db.mu.Lock()
-		db.shrinking = false
-		db.mu.Unlock()
-	}()
-	fname := db.file.Name()
-	tmpname := fname + ".tmp"
-	// the endpos is used to return to the end of the file when we are
-	// finished writing all of the current items.
-	endpos, err := db.file.Seek(0, 2)
-	if err != nil {
-		return err
+	return item
+}
+
+// changes returns the changes of a transaction, ordered by key.
+func (tx *Tx) changes(seq uint64) []Change {
+	keys := make([]string, 0, len(tx.rollbacks))
+	for key := range tx.rollbacks {
+		keys = append(keys, key)
 	}
-	db.mu.Unlock()
-	f, err := os.Create(tmpname)
-	if err != nil {
-		return err
+	sort.Strings(keys)
+	changes := make([]Change, 0, len(keys))
+	for _, key := range keys {
+		changes = append(changes,
+			newChange(seq, key, tx.db.get(key), tx.expires[key]))
 	}
-	defer func() {
-		_ = f.Close()
-		_ = os.RemoveAll(tmpname)
-	}()
+	return changes
+}
 
-	// we are going to read items in as chunks as to not hold up the database
-	// for too long.
-	wr := bufio.NewWriter(f)
-	pivot := ""
-	done := false
-	for !done {
-		err := func() error {
-			db.mu.RLock()
-			defer db.mu.RUnlock()
-			if db.closed {
-				return ErrDatabaseClosed
-			}
-			n := 0
+// record adds the changes of a committed transaction to the ring.
+func (db *DB) record(tx *Tx) {
+	db.ring = append(db.ring, tx.changes(db.seq)...)
+	// Only whole transactions are removed from the ring.
+	var i int
+	for len(db.ring)-i > db.config.ChangeRingSize {
+		seq := db.ring[i].Seq
+		for i < len(db.ring) && db.ring[i].Seq == seq {
+			i++
+		}
+	}
+	db.ring = db.ring[i:]
+}
+
+// Changes returns the changes that have been made by a read/write transaction
+// so far, ordered by key. The Seq of the changes is zero because the
+// transaction has not been committed.
+func (tx *Tx) Changes() ([]Change, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	} else if !tx.writable {
+		return nil, ErrTxNotWritable
+	}
+	return tx.changes(0), nil
+}
+
+// Context returns the context of the transaction, which is the one that was
+// passed to ViewContext() or UpdateContext(). Otherwise it's a context that is
+// never done.
+func (tx *Tx) Context() context.Context {
+	return tx.ctx
+}
+
+// interrupted returns the error of the context of the transaction when it's
+// done, which stops an iteration.
+func (tx *Tx) interrupted() error {
+	select {
+	case <-tx.ctx.Done():
+		return tx.ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// Seq returns the sequence number of the last committed transaction. A
+// sequence number is assigned to every transaction that changes the database.
+func (db *DB) Seq() (uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return 0, ErrDatabaseClosed
+	}
+	return db.seq, nil
+}
+
+// errStopChanges is used to stop reading the changes from the file.
+var errStopChanges = errors.New("stop changes")
+
+// ChangesSince calls fn for every change that was made by the transactions
+// with a sequence number greater than seq, in commit order. Iteration stops
+// when fn returns false. The recent changes are kept in memory and the older
+// ones are read from the database file. ErrCompacted is returned when the
+// changes are no longer available, such as after a Shrink() of the file or
+// when the database does not persist to disk.
+//
+// The function is called without holding the database lock, thus it's safe
+// to open transactions from within fn.
+func (db *DB) ChangesSince(seq uint64, fn func(c Change) bool) error {
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return ErrDatabaseClosed
+	}
+	if seq >= db.seq {
+		db.mu.RUnlock()
+		return nil
+	}
+	if len(db.ring) > 0 && db.ring[0].Seq <= seq+1 {
+		// The ring has all of the changes.
+		var changes []Change
+		for _, c := range db.ring {
+			if c.Seq > seq {
+				changes = append(changes, c)
+			}
+		}
+		db.mu.RUnlock()
+		for _, c := range changes {
+			if !fn(c) {
+				break
+			}
+		}
+		return nil
+	}
+	if !db.persist || seq < db.seqbase {
+		db.mu.RUnlock()
+		return ErrCompacted
+	}
+	// The file is opened and measured while holding the lock, which
+	// ensures that it only has complete transactions.
+	f, err := os.Open(db.path)
+	if err != nil {
+		db.mu.RUnlock()
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	fi, err := f.Stat()
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	_, err = readAOF(io.LimitReader(f, fi.Size()), func(cmds [][]string) error {
+		if len(cmds) == 0 || len(cmds[0]) != 2 ||
+			strings.ToLower(cmds[0][0]) != "seq" {
+			// Not a transaction with changes.
+			return nil
+		}
+		tseq, err := strconv.ParseUint(cmds[0][1], 10, 64)
+		if err != nil {
+			return err
+		}
+		if tseq <= seq {
+			return nil
+		}
+		for _, parts := range cmds[1:] {
+			c, err := loadChange(tseq, parts)
+			if err != nil {
+				return err
+			}
+			if !fn(c) {
+				return errStopChanges
+			}
+		}
+		return nil
+	})
+	if err == errStopChanges {
+		return nil
+	}
+	return err
+}
+
+// loadChange returns the change for a set, del, expireat, or persist record.
+func loadChange(seq uint64, parts []string) (Change, error) {
+	if len(parts) == 0 {
+		return Change{}, ErrInvalid
+	}
+	switch strings.ToLower(parts[0]) {
+	case "del":
+		if len(parts) != 2 {
+			return Change{}, ErrInvalid
+		}
+		return newChange(seq, parts[1], nil, false), nil
+	case "set", "expireat", "persist":
+		item, err := loadItem(parts)
+		if err != nil {
+			return Change{}, err
+		}
+		ttl := strings.ToLower(parts[0]) != "set"
+		return newChange(seq, item.key, item, ttl), nil
+	}
+	return Change{}, ErrInvalid
+}
+
+// Approximate number of bytes that are used by an item and by an index entry,
+// not including the key and value.
+const (
+	itemOverhead  = 96
+	indexOverhead = 32
+)
+
+// itemSize returns the approximate number of bytes that are used by the item
+// in the keys tree and in the indexes that match the key. The number of
+// matching indexes is counted when the item is inserted.
+func itemSize(item *dbItem) int64 {
+	return int64(len(item.key)+len(item.val)+itemOverhead) +
+		int64(item.idxn)*indexOverhead
+}
+
+// MemoryUsage returns the approximate number of bytes that are used by the
+// keys, values and index entries. This is the value that is compared to the
+// MaxMemory config.
+func (db *DB) MemoryUsage() (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return 0, ErrDatabaseClosed
+	}
+	return db.memsize, nil
+}
+
+// evictionSamples is the number of items that are compared when choosing the
+// item to evict. Like Redis, the LRU and LFU policies are approximated.
+const evictionSamples = 16
+
+// evictionCandidate returns the item that should be evicted next based on the
+// eviction policy, or nil if there is no such item. The item with the protect
+// key is never returned.
+func (db *DB) evictionCandidate(protect string) *dbItem {
+	var tr *btree.BTree
+	policy := db.config.EvictionPolicy
+	switch policy {
+	default:
+		return nil
+	case AllKeysLRU, AllKeysLFU:
+		tr = db.keys
+	case VolatileLRU, VolatileTTL:
+		tr = db.exps
+	}
+	var best *dbItem
+	var n int
+	iter := func(item btree.Item) bool {
+		dbi := item.(*dbItem)
+		if dbi.key == protect {
+			return true
+		}
+		n++
+		if best == nil || evictsBefore(policy, dbi, best) {
+			best = dbi
+		}
+		// The expires tree is ordered by the expiration, thus the first
+		// item is always the best for the VolatileTTL policy.
+		return policy != VolatileTTL && n < evictionSamples
+	}
+	if policy != VolatileTTL && db.evictpvt != nil {
+		// Continue sampling where the previous eviction left off.
+		tr.AscendGreaterOrEqual(db.evictpvt, iter)
+	}
+	if best == nil || (policy != VolatileTTL && n < evictionSamples) {
+		tr.Ascend(iter)
+	}
+	if best != nil {
+		db.evictpvt = best
+	}
+	return best
+}
+
+// evictsBefore returns true when item a should be evicted before item b.
+func evictsBefore(policy EvictionPolicy, a, b *dbItem) bool {
+	if policy == AllKeysLFU {
+		ah, bh := atomic.LoadUint32(&a.hits), atomic.LoadUint32(&b.hits)
+		if ah != bh {
+			return ah < bh
+		}
+	}
+	return atomic.LoadInt64(&a.atime) < atomic.LoadInt64(&b.atime)
+}
+
+// evict makes room for the item by deleting other items, until the database
+// uses no more than the MaxMemory limit after the item is inserted. It's called
+// by every change that inserts an item. ErrOutOfMemory is returned when there
+// is not enough room.
+func (tx *Tx) evict(item *dbItem) error {
+	if tx.db.config.MaxMemory <= 0 {
+		// There's no limit.
+		return nil
+	}
+	item.idxn = 0
+	for _, idx := range tx.db.idxs {
+		if wildcardMatch(item.key, idx.pattern) {
+			item.idxn++
+		}
+	}
+	usage := tx.db.memsize + itemSize(item)
+	if cur := tx.db.get(item.key); cur != nil {
+		usage -= itemSize(cur)
+	}
+	for usage > tx.db.config.MaxMemory {
+		victim := tx.db.evictionCandidate(item.key)
+		if victim == nil {
+			return ErrOutOfMemory
+		}
+		usage -= itemSize(victim)
+		// The eviction is written to the aof as a DEL record when the
+		// transaction is committed.
+		if _, err := tx.Delete(victim.key); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// backgroundManager runs continuously in the background and performs various
+// operations such as removing expired items and syncing to disk.
+func (db *DB) backgroundManager(interval time.Duration) {
+	flushes := 0
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		var shrink bool
+		var expired []*dbItem               // the items that have been removed
+		var onExpired func(key, val string) // called for each removed item
+		// Open a standard view. This will take a full lock of the
+		// database thus allowing for access to anything we need.
+		err := db.managed(context.Background(), true, true, func(tx *Tx) error {
+			onExpired = db.config.OnExpired
+			if db.persist && !db.config.AutoShrinkDisabled {
+				pos, err := db.file.Seek(0, 1)
+				if err != nil {
+					return err
+				}
+				aofsz := int(pos)
+				if aofsz > db.config.AutoShrinkMinSize {
+					perc := float64(db.config.AutoShrinkPercentage) / 100.0
+					shrink = aofsz > db.lastaofsz+int(float64(db.lastaofsz)*perc)
+				}
+			}
+			// refresh the expiration of the sliding items that have been
+			// read since the last run.
+			db.touchmu.Lock()
+			touches := db.touches
+			db.touches = nil
+			db.touchmu.Unlock()
+			if db.replica != nil {
+				// A follower receives the changes to the expirations
+				// from the leader.
+				touches = nil
+			}
+			for key := range touches {
+				if err := tx.slide(key); err != nil {
+					return err
+				}
+			}
+			// produce a list of expired items that need removing
+			var remove []*dbItem
+			if db.replica == nil {
+				db.exps.AscendLessThan(&dbItem{
+					opts: &dbItemOpts{ex: true, exat: time.Now()},
+				}, func(item btree.Item) bool {
+					remove = append(remove, item.(*dbItem))
+					return true
+				})
+			}
+			for _, item := range remove {
+				if !item.expired() {
+					// A sliding item that has been read after it was
+					// written.
+					if err := tx.slide(item.key); err != nil {
+						return err
+					}
+					continue
+				}
+				if db.config.OnExpiredSync != nil {
+					err := db.config.OnExpiredSync(item.key, item.val, tx)
+					if err != nil {
+						return err
+					}
+					if cur := db.get(item.key); cur != item {
+						// The item was replaced or deleted by the
+						// function, which takes care of this item.
+						if cur == nil {
+							expired = append(expired, item)
+						}
+						continue
+					}
+				}
+				if _, err := tx.Delete(item.key); err != nil {
+					// it's ok to get a "not found" because the
+					// 'Delete' method reports "not found" for
+					// expired items.
+					if err != ErrNotFound {
+						return err
+					}
+				}
+				expired = append(expired, item)
+			}
+
+			// execute a disk sync.
+			if db.persist && db.config.SyncPolicy == EverySecond &&
+				flushes != db.flushes {
+				_ = db.file.Sync()
+				flushes = db.flushes
+			}
+			return nil
+		})
+		if err == ErrDatabaseClosed {
+			break
+		}
+		if err == nil && onExpired != nil {
+			// The function is called outside of the database lock, which
+			// allows for opening new transactions.
+			for _, item := range expired {
+				onExpired(item.key, item.val)
+			}
+		}
+		if shrink {
+			if err = db.Shrink(); err != nil {
+				if err == ErrDatabaseClosed {
+					break
+				}
+			}
+		}
+	}
+}
+
+// tailManager runs continuously in the background on a read-only database and
+// reads the records that have been appended to the file by another process.
+func (db *DB) tailManager(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		if err := db.tail(); err == ErrDatabaseClosed {
+			break
+		}
+	}
+}
+
+// tail reads the new records from the end of a read-only database file. When
+// the file has been replaced, such as by a Shrink() from the writer process,
+// the database is reloaded from the new file.
+func (db *DB) tail() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	cfi, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(fi, cfi) {
+		f, err := os.Open(db.path)
+		if err != nil {
+			return err
+		}
+		if db.config.SharedLock {
+			if err := lockFile(f, true); err != nil {
+				_ = f.Close()
+				return err
+			}
+		}
+		_ = db.file.Close()
+		db.file = f
+		db.tailpos = 0
+		// Empty the database and all indexes.
+		db.keys = btree.New(db.config.BTreeDegree, nil)
+		db.exps = btree.New(db.config.BTreeDegree, &exctx{db})
+		db.memsize = 0
+		for _, idx := range db.idxs {
+			db.buildIndex(idx)
+		}
+	} else if fi.Size() == db.tailpos {
+		// Nothing new.
+		return nil
+	}
+	if _, err := db.file.Seek(db.tailpos, 0); err != nil {
+		return err
+	}
+	n, err := db.readLoad(db.file)
+	db.tailpos += n
+	db.publish()
+	if err == io.ErrUnexpectedEOF {
+		// The writer has not finished writing the last record.
+		return nil
+	}
+	return err
+}
+
+// Shrink will make the database file smaller by removing redundant
+// log entries. This operation does not block the database.
+func (db *DB) Shrink() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrDatabaseClosed
+	}
+	if !db.persist {
+		// The database was opened with ":memory:" as the path.
+		// There is no persistence, and no need to do anything here.
+		db.mu.Unlock()
+		return nil
+	}
+	if db.config.ReadOnly {
+		// The database file cannot be modified.
+		db.mu.Unlock()
+		return ErrInvalidOperation
+	}
+	if db.shrinking {
+		// The database is already in the process of shrinking.
+		db.mu.Unlock()
+		return ErrShrinkInProcess
+	}
+	db.shrinking = true
+	defer func() {
+		db.mu.Lock()
+		db.shrinking = false
+		db.mu.Unlock()
+	}()
+	fname := db.path
+	tmpname := fname + ".tmp"
+	// the endpos is used to return to the end of the file when we are
+	// finished writing all of the current items.
+	endpos, err := db.file.Seek(0, 2)
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	// the changes up to seq are removed from the file.
+	seq := db.seq
+	// the persisted index definitions are written ahead of the items.
+	var idxs []*index
+	for _, idx := range db.idxs {
+		if idx.fname != "" {
+			idxs = append(idxs, idx)
+		}
+	}
+	db.mu.Unlock()
+	f, err := os.OpenFile(tmpname, os.O_CREATE|os.O_RDWR|os.O_TRUNC,
+		db.config.FileMode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			// The files were not swapped.
+			_ = f.Close()
+			_ = os.RemoveAll(tmpname)
+		}
+	}()
+	// The new file is locked before it replaces the current file. This
+	// ensures that another process cannot take the lock during the swap.
+	if err := lockFile(f, false); err != nil {
+		return err
+	}
+
+	// we are going to read items in as chunks as to not hold up the database
+	// for too long.
+	wr := bufio.NewWriter(f)
+	if seq > 0 {
+		writeMultiBulk(wr, "compacted", strconv.FormatUint(seq, 10))
+	}
+	for _, idx := range idxs {
+		idx.writeCreateTo(wr)
+	}
+	pivot := ""
+	done := false
+	for !done {
+		err := func() error {
+			db.mu.RLock()
+			defer db.mu.RUnlock()
+			if db.closed {
+				return ErrDatabaseClosed
+			}
+			n := 0
 			done = true
 			db.keys.AscendGreaterOrEqual(&dbItem{key: pivot},
 				func(item btree.Item) bool {
@@ -587,8 +1813,8 @@ func (db *DB) Shrink() error {
 			return ErrDatabaseClosed
 		}
 		// We are going to open a new version of the aof file so that we do
-		// not change the seek position of the previous. This may cause a
-		// problem in the future if we choose to use syscall file locking.
+		// not change the seek position of the previous. The advisory lock
+		// does not prevent this process from reading the file.
 		aof, err := os.Open(fname)
 		if err != nil {
 			return err
@@ -602,24 +1828,17 @@ func (db *DB) Shrink() error {
 		if _, err := io.Copy(f, aof); err != nil {
 			return err
 		}
-		// Close all files
 		if err := aof.Close(); err != nil {
 			return err
 		}
-		if err := f.Close(); err != nil {
-			return err
-		}
-		if err := db.file.Close(); err != nil {
-			return err
-		}
 		// Any failures below here is really bad. So just panic.
 		if err := os.Rename(tmpname, fname); err != nil {
 			panic(err)
 		}
-		db.file, err = os.OpenFile(fname, os.O_CREATE|os.O_RDWR, 0666)
-		if err != nil {
-			panic(err)
-		}
+		// The previous file is closed after the rename, which releases its
+		// lock. The new file is already locked and is used from here on.
+		_ = db.file.Close()
+		db.file, f = f, nil
 		pos, err := db.file.Seek(0, 2)
 		if err != nil {
 			return err
@@ -627,9 +1846,216 @@ func (db *DB) Shrink() error {
 		// reset the bufio writer
 		db.bufw = bufio.NewWriter(db.file)
 		db.lastaofsz = int(pos)
+		db.seqbase = seq
 		return nil
 	}()
 }
+
+// Recover repairs a database file that cannot be opened due to a partially
+// written or corrupted command, such as the result of a crash during a write.
+// The file is truncated at the end of the last fully valid transaction and the
+// number of bytes that were discarded is returned. Zero is returned when the
+// file is valid. The database must not be open while it's being recovered.
+func Recover(path string) (discarded int64, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+	if err := lockFile(f, false); err != nil {
+		return 0, err
+	}
+	return recoverFile(f)
+}
+
+// recoverFile truncates the file at the end of the last fully valid
+// transaction and returns the number of bytes that were discarded. The file is
+// read from the start and is left at the start.
+func recoverFile(f *os.File) (discarded int64, err error) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if _, serr := f.Seek(0, 0); serr != nil && err == nil {
+			err = serr
+		}
+	}()
+	n, err := newLoader().readLoad(f)
+	if errors.Is(err, ErrFuncNotRegistered) {
+		// Not a problem with the file format.
+		return 0, err
+	}
+	size, err := f.Seek(0, 2)
+	if err != nil {
+		return 0, err
+	}
+	if n == size {
+		return 0, nil
+	}
+	if err := f.Truncate(n); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return size - n, nil
+}
+
+// Verify checks a database file without opening the database. The file is
+// read with the same parser that Open() uses and the number of bytes that are
+// valid is returned. When the whole file is valid the offset is the size of
+// the file and the error is nil. Otherwise the offset is the position of the
+// first transaction or command that could not be loaded. A transaction that
+// was not fully written, which Open() discards, is reported as
+// io.ErrUnexpectedEOF. The definitions of indexes with functions that have
+// not been registered are not an error, like with SkipUnregisteredIndexes.
+//
+// The file is not locked, thus it may be verified while another process has
+// the database open.
+func Verify(path string) (offset int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+	db := newLoader()
+	db.config.ReadOnly = true
+	db.config.SkipUnregisteredIndexes = true
+	n, err := db.readLoad(f)
+	if err != nil {
+		return n, err
+	}
+	size, err := f.Seek(0, 2)
+	if err != nil {
+		return n, err
+	}
+	if n < size {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+// newLoader returns a database that is only used to read a file, such as for
+// Recover() and Verify().
+func newLoader() *DB {
+	db := &DB{}
+	db.config = DefaultConfig()
+	db.keys = btree.New(db.config.BTreeDegree, nil)
+	db.exps = btree.New(db.config.BTreeDegree, &exctx{db})
+	db.idxs = make(map[string]*index)
+	return db
+}
+
+// Save writes a consistent point-in-time snapshot of the database to the
+// writer. The snapshot contains all of the items and the persisted index
+// definitions, and uses the same format as the database file. Thus the
+// snapshot is itself a valid database file that can be opened with Open().
+//
+// The snapshot is the same one that read-only transactions see, thus the
+// database is not locked, and other transactions can continue while it's being
+// written.
+func (db *DB) Save(wr io.Writer) error {
+	_, err := db.save(wr)
+	return err
+}
+
+// save writes a snapshot and returns the sequence number of the last
+// transaction in the snapshot.
+func (db *DB) save(wr io.Writer) (uint64, error) {
+	// The snapshot of the read-only transactions is not affected by changes
+	// to the database.
+	db.snapmu.RLock()
+	snap := db.snap
+	db.snapmu.RUnlock()
+	if snap == nil {
+		return 0, ErrDatabaseClosed
+	}
+	w := bufio.NewWriter(wr)
+	if snap.seq > 0 {
+		writeMultiBulk(w, "compacted", strconv.FormatUint(snap.seq, 10))
+	}
+	for _, idx := range snap.idxs {
+		if idx.fname != "" {
+			idx.writeCreateTo(w)
+		}
+	}
+	for _, parts := range snap.skipped {
+		writeMultiBulk(w, parts...)
+	}
+	snap.keys.Ascend(func(item btree.Item) bool {
+		item.(*dbItem).writeSetTo(w)
+		return true
+	})
+	return snap.seq, w.Flush()
+}
+
+// Load reads a snapshot that was created by Save() and restores it into the
+// database. The database must be empty, otherwise ErrInvalidOperation is
+// returned. When the database persists to disk, the restored items are written
+// to the database file as a single transaction. In the event of an error, the
+// database is left empty.
+func (db *DB) Load(rd io.Reader) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	if db.config.ReadOnly || db.replica != nil {
+		return ErrTxNotWritable
+	}
+	if db.keys.Len() != 0 {
+		return ErrInvalidOperation
+	}
+	idxs := make(map[string]*index, len(db.idxs))
+	for name, idx := range db.idxs {
+		idxs[name] = idx
+	}
+	err := func() error {
+		cr := &countReader{r: rd}
+		n, err := db.readLoad(cr)
+		if err != nil {
+			return err
+		}
+		if n != cr.n {
+			// The snapshot ends with an incomplete transaction.
+			return io.ErrUnexpectedEOF
+		}
+		if !db.persist {
+			return nil
+		}
+		return db.writeTx(func(wr *bufio.Writer) {
+			if db.seqbase > 0 {
+				writeMultiBulk(wr, "compacted",
+					strconv.FormatUint(db.seqbase, 10))
+			}
+			for _, idx := range db.idxs {
+				if idx.fname != "" && idxs[idx.name] != idx {
+					idx.writeCreateTo(wr)
+				}
+			}
+			db.keys.Ascend(func(item btree.Item) bool {
+				item.(*dbItem).writeSetTo(wr)
+				return true
+			})
+		})
+	}()
+	if err != nil {
+		// Return the database to the empty state.
+		db.keys = btree.New(db.config.BTreeDegree, nil)
+		db.exps = btree.New(db.config.BTreeDegree, &exctx{db})
+		db.memsize = 0
+		db.idxs = idxs
+		for _, idx := range db.idxs {
+			db.buildIndex(idx)
+		}
+		db.publish()
+		return err
+	}
+	db.committed()
+	db.publish()
+	return nil
+}
+
 func loadReadLine(r *bufio.Reader) (string, error) {
 	line, err := r.ReadBytes('\n')
 	if err != nil {
@@ -701,84 +2127,379 @@ func loadReadCommand(r *bufio.Reader) ([]string, error) {
 // load reads entries from the append only database file and fills the database.
 // The file format uses the Redis append only file format, which is and a series
 // of RESP commands. For more information on RESP please read
-// http://redis.io/topics/protocol. The only supported RESP commands are DEL and
-// SET.
+// http://redis.io/topics/protocol. The only supported RESP commands are DEL,
+// SET, CREATEINDEX, CREATESPATIALINDEX, DROPINDEX, CHECKSUM, MULTI, and EXEC.
 func (db *DB) load() error {
-	r := bufio.NewReader(db.file)
+	n, err := db.readLoad(db.file)
+	if err != nil {
+		return err
+	}
+	pos, err := db.file.Seek(0, 2)
+	if err != nil {
+		return err
+	}
+	if db.config.ReadOnly {
+		// Tailing continues from the end of the last valid record.
+		db.tailpos = n
+	} else if n < pos {
+		// The file ends with a transaction that was not fully written.
+		// Remove it so that new records are appended to a valid file.
+		if err := db.file.Truncate(n); err != nil {
+			return err
+		}
+		if pos, err = db.file.Seek(n, 0); err != nil {
+			return err
+		}
+	}
+	db.lastaofsz = int(pos)
+	return nil
+}
+
+// countReader counts the number of bytes read from the underlying reader.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// multiRecord and checksumRecord are the leading bytes of the first record of
+// a transaction in the aof.
+var (
+	multiRecord    = []byte("*1\r\n$5\r\nmulti\r\n")
+	checksumRecord = []byte("*3\r\n$8\r\nchecksum\r\n")
+)
+
+// isRecordPrefix returns true if head and the record share the same prefix.
+// The head must be at least min bytes long.
+func isRecordPrefix(head, record []byte, min int) bool {
+	return len(head) >= min &&
+		(bytes.HasPrefix(record, head) || bytes.HasPrefix(head, record))
+}
+
+// readLoad reads and processes commands from the reader until the end of the
+// stream is reached. The number of bytes that were processed, up to the end of
+// the last valid command, is returned. This value can be used to find the
+// position of a partially written or corrupted command.
+//
+// Transactions are wrapped in MULTI and EXEC records. The commands in a
+// transaction are only processed once the EXEC is read. A transaction that was
+// not fully written to the end of the stream, such as the result of a crash
+// during a write, is discarded and the returned position will be the start of
+// that transaction.
+func (db *DB) readLoad(rd io.Reader) (int64, error) {
+	return readAOF(rd, func(cmds [][]string) error {
+		for _, parts := range cmds {
+			if err := db.loadCommand(parts); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readAOF reads the records from an aof and calls apply for the commands of
+// each transaction, or for each command that is not part of a transaction.
+// The return values are the same as readLoad().
+func readAOF(rd io.Reader, apply func(cmds [][]string) error) (int64, error) {
+	cr := &countReader{r: rd}
+	r := bufio.NewReader(cr)
+	var batch [][]string // the commands in the current transaction
+	var multi bool       // a transaction is in progress
+	var pos int64        // the position of the current transaction
 	for {
-		var item = &dbItem{}
+		n := cr.n - int64(r.Buffered())
+		if !multi {
+			pos = n
+		}
+		head, _ := r.Peek(len(checksumRecord))
+		// A CHECKSUM record has the same leading bytes as a SET record
+		// without an expiration. The first six bytes are needed to tell
+		// them apart.
+		begin := isRecordPrefix(head, multiRecord, 1) ||
+			isRecordPrefix(head, checksumRecord, 6)
+		var cmds [][]string
 		parts, err := loadReadCommand(r)
+		if err == nil {
+			if len(parts) > 0 && strings.ToLower(parts[0]) == "checksum" {
+				cmds, err = loadChecksum(r, parts)
+			} else {
+				cmds = [][]string{parts}
+			}
+		}
 		if err != nil {
-			if err == errValidEOF {
-				break
+			if err == errValidEOF && !multi {
+				return n, nil
 			}
-			if err == io.EOF {
-				return io.ErrUnexpectedEOF
+			if err == errValidEOF || err == io.EOF ||
+				err == io.ErrUnexpectedEOF {
+				if multi || begin {
+					// The last transaction was not fully written.
+					return pos, nil
+				}
+				return n, io.ErrUnexpectedEOF
 			}
-			return err
-		}
-		if len(parts) == 0 {
-			continue
+			return n, err
 		}
-		switch strings.ToLower(parts[0]) {
-		default:
-			return ErrInvalid
-		case "set":
-			if len(parts) < 3 || len(parts) == 4 || len(parts) > 5 {
-				return ErrInvalid
+		for _, parts := range cmds {
+			if len(parts) == 0 {
+				continue
 			}
-			item.key, item.val = parts[1], parts[2]
-			if len(parts) == 5 {
-				if strings.ToLower(parts[3]) != "ex" {
-					return ErrInvalid
+			switch strings.ToLower(parts[0]) {
+			case "multi":
+				if len(parts) != 1 || multi {
+					return pos, ErrInvalid
 				}
-				ex, err := strconv.ParseInt(parts[4], 10, 64)
-				if err != nil {
-					return err
+				multi = true
+			case "exec":
+				if len(parts) != 1 || !multi {
+					return pos, ErrInvalid
+				}
+				if err := apply(batch); err != nil {
+					return pos, err
 				}
-				dur := time.Duration(ex) * time.Second
-				item.opts = &dbItemOpts{
-					ex:   true,
-					exat: time.Now().Add(dur),
+				batch = batch[:0]
+				multi = false
+			default:
+				if multi {
+					batch = append(batch, parts)
+				} else if err := apply([][]string{parts}); err != nil {
+					return n, err
 				}
 			}
-			db.insertIntoDatabase(item)
-		case "del":
-			if len(parts) != 2 {
-				return ErrInvalid
+		}
+	}
+}
+
+// loadChecksum reads and verifies a batch of commands that follow a CHECKSUM
+// record. The record has the form "checksum <crc32> <size>" where size is the
+// number of bytes in the batch. The commands are only returned when the full
+// batch is valid.
+func loadChecksum(r *bufio.Reader, parts []string) ([][]string, error) {
+	if len(parts) != 3 {
+		return nil, ErrInvalid
+	}
+	crc, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseUint(parts[2], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	// The size is not trusted until the batch is verified, thus the buffer
+	// only grows with the bytes that are actually read.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	data := buf.Bytes()
+	if crc32.ChecksumIEEE(data) != uint32(crc) {
+		return nil, ErrInvalid
+	}
+	var cmds [][]string
+	br := bufio.NewReader(bytes.NewReader(data))
+	for {
+		parts, err := loadReadCommand(br)
+		if err != nil {
+			if err == errValidEOF {
+				break
 			}
-			item.key = parts[1]
-			db.deleteFromDatabase(item)
+			return nil, ErrInvalid
+		}
+		if len(parts) > 0 && strings.ToLower(parts[0]) == "checksum" {
+			return nil, ErrInvalid
 		}
+		cmds = append(cmds, parts)
 	}
-	pos, err := db.file.Seek(0, 2)
+	return cmds, nil
+}
+
+// loadCommand processes a single command that was read from the aof.
+func (db *DB) loadCommand(parts []string) error {
+	var item = &dbItem{}
+	if len(parts) == 0 {
+		return nil
+	}
+	switch strings.ToLower(parts[0]) {
+	default:
+		return ErrInvalid
+	case "set":
+		item, err := loadItem(parts)
+		if err != nil {
+			return err
+		}
+		db.insertIntoDatabase(item)
+	case "del":
+		if len(parts) != 2 {
+			return ErrInvalid
+		}
+		item.key = parts[1]
+		db.deleteFromDatabase(item)
+	case "expireat", "persist":
+		exp, err := loadItem(parts)
+		if err != nil {
+			return err
+		}
+		cur := db.get(exp.key)
+		if cur == nil {
+			// The item was deleted or never existed.
+			return nil
+		}
+		item.key, item.val, item.opts = cur.key, cur.val, exp.opts
+		db.insertIntoDatabase(item)
+	case "createindex", "createspatialindex":
+		if len(parts) != 4 {
+			return ErrInvalid
+		}
+		idx := &index{
+			name:    parts[1],
+			pattern: parts[2],
+			fname:   parts[3],
+			db:      db,
+		}
+		funcs.mu.RLock()
+		if strings.ToLower(parts[0]) == "createindex" {
+			idx.less = funcs.less[idx.fname]
+		} else {
+			idx.rect = funcs.rect[idx.fname]
+		}
+		funcs.mu.RUnlock()
+		if idx.less == nil && idx.rect == nil {
+			if !db.config.ReadOnly || !db.config.SkipUnregisteredIndexes {
+				return &FuncNotRegisteredError{Name: idx.fname}
+			}
+			if db.skipped == nil {
+				db.skipped = make(map[string][]string)
+			}
+			db.skipped[idx.name] = append([]string(nil), parts...)
+			return nil
+		}
+		delete(db.skipped, idx.name)
+		db.buildIndex(idx)
+	case "seq", "compacted":
+		if len(parts) != 2 {
+			return ErrInvalid
+		}
+		seq, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		if strings.ToLower(parts[0]) == "compacted" {
+			// The changes up to seq are not in the file.
+			db.seqbase = seq
+			db.ring = nil
+		}
+		if seq > db.seq {
+			db.seq = seq
+		}
+	case "dropindex":
+		if len(parts) != 2 {
+			return ErrInvalid
+		}
+		if idx, ok := db.idxs[parts[1]]; ok {
+			db.removeIndex(idx)
+		}
+		delete(db.skipped, parts[1])
+	}
+	return nil
+}
+
+// loadItem parses a set, expireat, or persist record. The returned item does
+// not have a value for the expireat and persist records.
+func loadItem(parts []string) (*dbItem, error) {
+	item := &dbItem{}
+	var exparts []string // the expiration arguments
+	switch strings.ToLower(parts[0]) {
+	case "set":
+		if len(parts) < 3 || len(parts)%2 == 0 || len(parts) > 7 {
+			return nil, ErrInvalid
+		}
+		item.key, item.val = parts[1], parts[2]
+		exparts = parts[3:]
+	case "expireat":
+		if len(parts) != 3 && len(parts) != 5 {
+			return nil, ErrInvalid
+		}
+		item.key = parts[1]
+		exparts = append([]string{"exat"}, parts[2:]...)
+	case "persist":
+		if len(parts) != 2 {
+			return nil, ErrInvalid
+		}
+		item.key = parts[1]
+	default:
+		return nil, ErrInvalid
+	}
+	if len(exparts) == 0 {
+		return item, nil
+	}
+	ex, err := strconv.ParseInt(exparts[1], 10, 64)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	switch strings.ToLower(exparts[0]) {
+	default:
+		return nil, ErrInvalid
+	case "ex":
+		// Legacy format. The number of seconds remaining at the time the
+		// record was written.
+		dur := time.Duration(ex) * time.Second
+		item.opts = &dbItemOpts{ex: true, exat: time.Now().Add(dur)}
+	case "exat":
+		// The absolute unix time in nanoseconds.
+		item.opts = &dbItemOpts{ex: true, exat: time.Unix(0, ex)}
+	}
+	if len(exparts) == 4 {
+		ttl, err := loadSliding(exparts[2:])
+		if err != nil || strings.ToLower(exparts[0]) != "exat" {
+			return nil, ErrInvalid
+		}
+		item.opts.ttl = ttl
+	}
+	return item, nil
+}
+
+// loadSliding parses the "sliding <ttl>" arguments of a record.
+func loadSliding(parts []string) (time.Duration, error) {
+	if strings.ToLower(parts[0]) != "sliding" {
+		return 0, ErrInvalid
 	}
-	db.lastaofsz = int(pos)
-	return nil
+	ttl, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || ttl <= 0 {
+		return 0, ErrInvalid
+	}
+	return time.Duration(ttl), nil
 }
 
 // managed calls a block of code that is fully contained in a transaction.
 // This method is intended to be wrapped by Update and View
-func (db *DB) managed(writable bool, fn func(tx *Tx) error) (err error) {
+func (db *DB) managed(ctx context.Context, writable, internal bool,
+	fn func(tx *Tx) error) (err error) {
 	var tx *Tx
-	tx, err = db.begin(writable)
+	tx, err = db.begin(ctx, writable, internal)
 	if err != nil {
 		return
 	}
 	defer func() {
 		if err != nil {
 			// The caller returned an error. We must rollback.
-			_ = tx.rollback()
+			_ = tx.Rollback()
 			return
 		}
 		if writable {
 			// Everything went well. Lets Commit()
-			err = tx.commit()
+			err = tx.Commit()
 		} else {
 			// read-only transaction can only roll back.
-			err = tx.rollback()
+			err = tx.Rollback()
 		}
 	}()
 	tx.funcd = true
@@ -796,7 +2517,14 @@ func (db *DB) managed(writable bool, fn func(tx *Tx) error) (err error) {
 // Executing a manual commit or rollback from inside the function will result
 // in a panic.
 func (db *DB) View(fn func(tx *Tx) error) error {
-	return db.managed(false, fn)
+	return db.managed(context.Background(), false, false, fn)
+}
+
+// ViewContext is like View, but the transaction is not started when the
+// context is done, and ctx.Err() is returned instead. The context is returned
+// by tx.Context(), and stops the iterations of the transaction when it's done.
+func (db *DB) ViewContext(ctx context.Context, fn func(tx *Tx) error) error {
+	return db.managed(ctx, false, false, fn)
 }
 
 // Update executes a function within a managed read/write transaction.
@@ -808,7 +2536,15 @@ func (db *DB) View(fn func(tx *Tx) error) error {
 // Executing a manual commit or rollback from inside the function will result
 // in a panic.
 func (db *DB) Update(fn func(tx *Tx) error) error {
-	return db.managed(true, fn)
+	return db.managed(context.Background(), true, false, fn)
+}
+
+// UpdateContext is like Update, but gives up waiting for another read/write
+// transaction to complete when the context is done, and returns ctx.Err()
+// instead. The context is returned by tx.Context(), and stops the iterations
+// of the transaction when it's done.
+func (db *DB) UpdateContext(ctx context.Context, fn func(tx *Tx) error) error {
+	return db.managed(ctx, true, false, fn)
 }
 
 // get return an item or nil if not found.
@@ -820,6 +2556,15 @@ func (db *DB) get(key string) *dbItem {
 	return nil
 }
 
+// get returns an item of the snapshot of the transaction or nil if not found.
+func (tx *Tx) get(key string) *dbItem {
+	item := tx.snap.keys.Get(&dbItem{key: key})
+	if item != nil {
+		return item.(*dbItem)
+	}
+	return nil
+}
+
 // Tx represents a transaction on the database. This transaction can either be
 // read-only or read/write. Read-only transactions can be used for retrieving
 // values for keys and iterating through keys and values. Read/write
@@ -832,49 +2577,109 @@ type Tx struct {
 	funcd     bool               // when true Commit and Rollback panic.
 	rollbacks map[string]*dbItem // cotnains details for rolling back tx.
 	commits   map[string]*dbItem // contains details for committing tx.
+	expires   map[string]bool    // keys whose commit only changes the ttl.
+	refreshes map[string]bool    // sliding keys that are not sent to watchers.
+	snap      *snapshot          // the items and indexes that are read.
+	ctx       context.Context    // stops the iterations when done.
+	undo      []undo             // the changes since the first savepoint.
+	points    []uint64           // the ids of the savepoints that are valid.
+	pointid   uint64             // the id of the last savepoint.
 }
 
-// begin opens a new transaction.
+// Begin opens a new transaction.
 // Multiple read-only transactions can be opened at the same time but there can
 // only be one read/write transaction at a time. Attempting to open a read/write
 // transactions while another one is in progress will result in blocking until
 // the current read/write transaction is completed.
 //
+// A read-only transaction reads a snapshot of the database as it was when the
+// last read/write transaction was committed. It does not lock the database,
+// thus it neither blocks nor is blocked by a read/write transaction, and it
+// does not see the changes that are committed after it was opened.
+//
 // All transactions must be closed by calling Commit() or Rollback() when done.
-func (db *DB) begin(writable bool) (*Tx, error) {
+func (db *DB) Begin(writable bool) (*Tx, error) {
+	return db.begin(context.Background(), writable, false)
+}
+
+// begin opens a new transaction. An internal transaction may write to a
+// database that is following a leader, which is needed by the replication and
+// the background manager. The transaction is not opened when the context is
+// done before the database is locked.
+func (db *DB) begin(ctx context.Context, writable, internal bool) (*Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	tx := &Tx{
 		db:       db,
 		writable: writable,
+		ctx:      ctx,
+	}
+	if !writable {
+		db.snapmu.RLock()
+		tx.snap = db.snap
+		db.snapmu.RUnlock()
+		if tx.snap == nil {
+			return nil, ErrDatabaseClosed
+		}
+		return tx, nil
+	}
+	if err := tx.lock(); err != nil {
+		return nil, err
 	}
-	tx.lock()
 	if db.closed {
 		tx.unlock()
 		return nil, ErrDatabaseClosed
 	}
-	if writable {
-		tx.rollbacks = make(map[string]*dbItem)
-		if db.persist {
-			tx.commits = make(map[string]*dbItem)
-		}
+	if db.config.ReadOnly || (db.replica != nil && !internal) {
+		tx.unlock()
+		return nil, ErrTxNotWritable
+	}
+	// A read/write transaction reads the database and its own changes.
+	tx.snap = &snapshot{keys: db.keys, idxs: db.idxs, config: db.config}
+	tx.rollbacks = make(map[string]*dbItem)
+	tx.expires = make(map[string]bool)
+	if db.persist {
+		tx.commits = make(map[string]*dbItem)
 	}
 	return tx, nil
 }
 
-// lock locks the database based on the transaction type.
-func (tx *Tx) lock() {
-	if tx.writable {
+// lock locks the database for a read/write transaction, unless the context of
+// the transaction is done first. A read-only transaction reads a snapshot and
+// does not lock the database.
+func (tx *Tx) lock() error {
+	if !tx.writable {
+		return nil
+	}
+	done := tx.ctx.Done()
+	if done == nil {
+		// The context is never done.
 		tx.db.mu.Lock()
-	} else {
-		tx.db.mu.RLock()
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		tx.db.mu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-done:
+		// The lock is released as soon as it's acquired.
+		go func() {
+			<-locked
+			tx.db.mu.Unlock()
+		}()
+		return tx.ctx.Err()
 	}
 }
 
-// unlock unlocks the database based on the transaction type.
+// unlock unlocks the database for a read/write transaction.
 func (tx *Tx) unlock() {
 	if tx.writable {
 		tx.db.mu.Unlock()
-	} else {
-		tx.db.mu.RUnlock()
 	}
 }
 
@@ -891,10 +2696,10 @@ func (tx *Tx) rollbackInner() {
 	}
 }
 
-// commit writes all changes to disk.
+// Commit writes all changes to disk.
 // An error is returned when a write error occurs, or when a Commit() is called
 // from a read-only transaction.
-func (tx *Tx) commit() error {
+func (tx *Tx) Commit() error {
 	if tx.funcd {
 		panic("managed tx commit not allowed")
 	}
@@ -903,28 +2708,39 @@ func (tx *Tx) commit() error {
 	} else if !tx.writable {
 		return ErrTxNotWritable
 	}
+	return tx.commit(tx.db.seq + 1)
+}
+
+// commit writes all changes to disk as the transaction with the provided
+// sequence number.
+func (tx *Tx) commit(seq uint64) error {
 	var err error
 	if tx.db.persist && len(tx.commits) > 0 {
 		// Each committed record is written to disk
-		for key, item := range tx.commits {
-			if item == nil {
-				(&dbItem{key: key}).writeDeleteTo(tx.db.bufw)
-			} else {
-				item.writeSetTo(tx.db.bufw)
+		err = tx.db.writeTx(func(wr *bufio.Writer) {
+			writeMultiBulk(wr, "seq", strconv.FormatUint(seq, 10))
+			for key, item := range tx.commits {
+				if item == nil {
+					(&dbItem{key: key}).writeDeleteTo(wr)
+				} else if tx.expires[key] {
+					item.writeExpireTo(wr)
+				} else {
+					item.writeSetTo(wr)
+				}
 			}
-		}
-		// Flushing the buffer only once per transaction.
+		})
 		// If this operation fails then the write did failed and we must
 		// rollback.
-		if err = tx.db.bufw.Flush(); err != nil {
+		if err != nil {
 			tx.rollbackInner()
 		}
-		if tx.db.config.SyncPolicy == Always {
-			_ = tx.db.file.Sync()
-		}
-		// Increment the number of flushes. The background syncing uses this.
-		tx.db.flushes++
-
+	}
+	if err == nil && len(tx.rollbacks) > 0 {
+		tx.db.seq = seq
+		tx.db.record(tx)
+		tx.db.notify(tx)
+		tx.db.committed()
+		tx.db.publish()
 	}
 	// Unlock the database and allow for another writable transaction.
 	tx.unlock()
@@ -933,11 +2749,11 @@ func (tx *Tx) commit() error {
 	return err
 }
 
-// rollback closes the transaction and reverts all mutable operations that
+// Rollback closes the transaction and reverts all mutable operations that
 // were performed on the transaction such as Set() and Delete().
 //
 // Read-only transactions can only be rolled back, not committed.
-func (tx *Tx) rollback() error {
+func (tx *Tx) Rollback() error {
 	if tx.funcd {
 		panic("managed tx rollback not allowed")
 	}
@@ -955,14 +2771,187 @@ func (tx *Tx) rollback() error {
 	return nil
 }
 
+// Savepoint is a point in a read/write transaction that the transaction can
+// be rolled back to with RollbackTo().
+type Savepoint struct {
+	tx *Tx    // the transaction of the savepoint
+	id uint64 // identifies the savepoint in the transaction
+	n  int    // the number of changes before the savepoint
+}
+
+// undo holds the details for reverting a change of a key, which are the item
+// and the commit details of the key before the change.
+type undo struct {
+	key       string
+	item      *dbItem // the previous item, nil when there was none
+	rollback  *dbItem // the rollbacks entry of the key
+	commit    *dbItem // the commits entry of the key
+	rollbacks bool    // the key was in the rollbacks map
+	commits   bool    // the key was in the commits map
+	expire    bool    // the key was in the expires map
+	refresh   bool    // the key was in the refreshes map
+}
+
+// remember records the details for reverting a change of a key to a
+// savepoint. It must be called before the commit details of the key are
+// updated. Nothing is recorded until the first savepoint is created.
+func (tx *Tx) remember(key string, prev *dbItem) {
+	if tx.undo == nil {
+		return
+	}
+	u := undo{key: key, item: prev}
+	u.rollback, u.rollbacks = tx.rollbacks[key]
+	u.commit, u.commits = tx.commits[key]
+	u.expire, u.refresh = tx.expires[key], tx.refreshes[key]
+	tx.undo = append(tx.undo, u)
+}
+
+// Savepoint returns the current point of a read/write transaction. The
+// changes that are made after the savepoint can be rolled back with
+// RollbackTo(), without rolling back the whole transaction.
+func (tx *Tx) Savepoint() Savepoint {
+	if tx.db == nil || !tx.writable {
+		return Savepoint{tx: tx, n: -1}
+	}
+	if tx.undo == nil {
+		tx.undo = make([]undo, 0, 8)
+	}
+	tx.pointid++
+	tx.points = append(tx.points, tx.pointid)
+	return Savepoint{tx: tx, id: tx.pointid, n: len(tx.undo)}
+}
+
+// point returns the position of a savepoint in the points of the
+// transaction, or -1 when the savepoint is no longer valid.
+func (tx *Tx) point(sp Savepoint) int {
+	if sp.tx != tx {
+		return -1
+	}
+	for i := len(tx.points) - 1; i >= 0; i-- {
+		if tx.points[i] == sp.id {
+			return i
+		}
+	}
+	return -1
+}
+
+// RollbackTo reverts the changes that were made after the savepoint, and the
+// transaction stays open. The savepoint may be used again, but the savepoints
+// that were created after it can no longer be used, for which
+// ErrInvalidOperation is returned. ErrInvalidOperation is also returned for a
+// savepoint of another transaction.
+func (tx *Tx) RollbackTo(sp Savepoint) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+	p := tx.point(sp)
+	if p == -1 || sp.n > len(tx.undo) {
+		return ErrInvalidOperation
+	}
+	// The changes are reverted in reverse order.
+	for i := len(tx.undo) - 1; i >= sp.n; i-- {
+		u := tx.undo[i]
+		if u.item == nil {
+			tx.db.deleteFromDatabase(&dbItem{key: u.key})
+		} else {
+			tx.db.insertIntoDatabase(u.item)
+		}
+		if u.rollbacks {
+			tx.rollbacks[u.key] = u.rollback
+		} else {
+			delete(tx.rollbacks, u.key)
+		}
+		if u.commits {
+			tx.commits[u.key] = u.commit
+		} else if tx.commits != nil {
+			delete(tx.commits, u.key)
+		}
+		if u.expire {
+			tx.expires[u.key] = true
+		} else {
+			delete(tx.expires, u.key)
+		}
+		if u.refresh {
+			tx.refreshes[u.key] = true
+		} else {
+			delete(tx.refreshes, u.key)
+		}
+	}
+	tx.undo = tx.undo[:sp.n]
+	// The savepoints that were created after this one are invalid, even
+	// when the undo log grows back past their position.
+	tx.points = tx.points[:p+1]
+	return nil
+}
+
+// Nested calls fn within the transaction. When fn returns an error, only the
+// changes that were made by fn are rolled back and the error is returned. The
+// transaction stays open, thus the caller decides whether the error aborts
+// the whole transaction.
+func (tx *Tx) Nested(fn func(tx *Tx) error) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+	sp := tx.Savepoint()
+	err := fn(tx)
+	if err != nil {
+		if rerr := tx.RollbackTo(sp); rerr != nil {
+			return rerr
+		}
+	}
+	// The savepoint is not used again.
+	if p := tx.point(sp); p != -1 {
+		tx.points = append(tx.points[:p], tx.points[p+1:]...)
+	}
+	return err
+}
+
 // dbItemOpts holds various meta information about an item.
 type dbItemOpts struct {
-	ex   bool      // does this item expire?
-	exat time.Time // when does this item expire?
+	touched int64         // unix nanos of the last read, atomic access only
+	ex      bool          // does this item expire?
+	exat    time.Time     // when does this item expire?
+	ttl     time.Duration // the sliding ttl, zero when not sliding
+}
+
+// copy returns a copy of the options for a new item. The copy does not share
+// the sliding state of the last read with the original.
+func (opts *dbItemOpts) copy() *dbItemOpts {
+	if opts == nil {
+		return nil
+	}
+	return &dbItemOpts{
+		touched: atomic.LoadInt64(&opts.touched),
+		ex:      opts.ex,
+		exat:    opts.exat,
+		ttl:     opts.ttl,
+	}
+}
+
+// deadline returns the time when the item will expire. For sliding items this
+// is the later of exat and the last read plus the ttl.
+func (opts *dbItemOpts) deadline() time.Time {
+	if opts.ttl > 0 {
+		if touched := atomic.LoadInt64(&opts.touched); touched != 0 {
+			if at := time.Unix(0, touched).Add(opts.ttl); at.After(opts.exat) {
+				return at
+			}
+		}
+	}
+	return opts.exat
 }
+
 type dbItem struct {
+	atime    int64       // unix nanos of the last access, atomic access only
 	key, val string      // the binary key and value
 	opts     *dbItemOpts // optional meta information
+	hits     uint32      // number of reads, atomic access only
+	keyless  bool        // a descending index pivot, not an item
+	idxn     int32       // the number of indexes that match the key
 }
 
 // writeHead writes the resp header part
@@ -983,27 +2972,66 @@ func writeMultiBulk(wr *bufio.Writer, bulks ...string) {
 }
 
 // writeSetTo writes an item as a single SET record to the a bufio Writer.
+// Items that expire are written with an absolute "exat" unix timestamp in
+// nanoseconds, thus the expiration is exact across database reloads. Sliding
+// items are followed by the "sliding" ttl in nanoseconds.
 func (dbi *dbItem) writeSetTo(wr *bufio.Writer) {
 	if dbi.opts != nil && dbi.opts.ex {
-		ex := strconv.FormatUint(
-			uint64(dbi.opts.exat.Sub(time.Now())/time.Second),
-			10,
-		)
-		writeMultiBulk(wr, "set", dbi.key, dbi.val, "ex", ex)
+		exat := strconv.FormatInt(dbi.opts.deadline().UnixNano(), 10)
+		if dbi.opts.ttl > 0 {
+			ttl := strconv.FormatInt(int64(dbi.opts.ttl), 10)
+			writeMultiBulk(wr, "set", dbi.key, dbi.val, "exat", exat,
+				"sliding", ttl)
+		} else {
+			writeMultiBulk(wr, "set", dbi.key, dbi.val, "exat", exat)
+		}
 	} else {
 		writeMultiBulk(wr, "set", dbi.key, dbi.val)
 	}
 }
 
+// writeExpireTo writes the expiration of an item as a single EXPIREAT record,
+// or as a PERSIST record when the item does not expire, to the a bufio Writer.
+func (dbi *dbItem) writeExpireTo(wr *bufio.Writer) {
+	if dbi.opts != nil && dbi.opts.ex {
+		exat := strconv.FormatInt(dbi.opts.deadline().UnixNano(), 10)
+		if dbi.opts.ttl > 0 {
+			ttl := strconv.FormatInt(int64(dbi.opts.ttl), 10)
+			writeMultiBulk(wr, "expireat", dbi.key, exat, "sliding", ttl)
+		} else {
+			writeMultiBulk(wr, "expireat", dbi.key, exat)
+		}
+	} else {
+		writeMultiBulk(wr, "persist", dbi.key)
+	}
+}
+
 // writeSetTo writes an item as a single DEL record to the a bufio Writer.
 func (dbi *dbItem) writeDeleteTo(wr *bufio.Writer) {
 	writeMultiBulk(wr, "del", dbi.key)
 }
 
+// writeCreateTo writes an index definition as a single CREATEINDEX or
+// CREATESPATIALINDEX record to the a bufio Writer.
+func (idx *index) writeCreateTo(wr *bufio.Writer) {
+	if idx.less != nil {
+		writeMultiBulk(wr, "createindex", idx.name, idx.pattern, idx.fname)
+	} else {
+		writeMultiBulk(wr, "createspatialindex", idx.name, idx.pattern,
+			idx.fname)
+	}
+}
+
+// writeDropTo writes a single DROPINDEX record to the a bufio Writer.
+func (idx *index) writeDropTo(wr *bufio.Writer) {
+	writeMultiBulk(wr, "dropindex", idx.name)
+}
+
 // expired evaluates id the item has expired. This will always return false when
 // the item does not have `opts.ex` set to true.
 func (dbi *dbItem) expired() bool {
-	return dbi.opts != nil && dbi.opts.ex && time.Now().After(dbi.opts.exat)
+	return dbi.opts != nil && dbi.opts.ex &&
+		time.Now().After(dbi.opts.deadline())
 }
 
 // MaxTime from http://stackoverflow.com/questions/25065055#32620397
@@ -1048,6 +3076,12 @@ func (dbi *dbItem) Less(item btree.Item, ctx interface{}) bool {
 		}
 	}
 	// Always fall back to the key comparison. This creates absolute uniqueness.
+	// A keyless pivot is greater than all of the items with the same value.
+	if dbi.keyless {
+		return false
+	} else if dbi2.keyless {
+		return true
+	}
 	return dbi.key < dbi2.key
 }
 
@@ -1069,6 +3103,27 @@ type SetOptions struct {
 	// before being evicted. The Expires field must also be set to true.
 	// TTL stands for Time-To-Live.
 	TTL time.Duration
+	// ExpiresAt is the absolute time when the key-value will be evicted.
+	// When not zero it's used instead of TTL. The Expires field must also be
+	// set to true.
+	ExpiresAt time.Time
+	// Sliding indicates that the expiration is extended by the TTL each
+	// time the item is read with Get(). The Expires field must also be set
+	// to true and the TTL must be greater than zero.
+	Sliding bool
+	// NX indicates that the Set() will only occur when the key does not
+	// already exist.
+	NX bool
+	// XX indicates that the Set() will only occur when the key already
+	// exists.
+	XX bool
+	// CAS indicates that the Set() will only occur when the key already
+	// exists and its value is equal to PrevValue.
+	// CAS stands for Compare-And-Swap.
+	CAS bool
+	// PrevValue is the expected value of the key. The CAS field must also be
+	// set to true.
+	PrevValue string
 }
 
 // Set inserts or replaces an item in the database based on the key.
@@ -1079,6 +3134,10 @@ type SetOptions struct {
 // value will be returned through the previousValue variable.
 // The results of this operation will not be available to other
 // transactions until the current transaction has successfully committed.
+//
+// When the opts param has the NX, XX, or CAS field set and the condition is
+// not met, the item is not set and ErrConditionFailed is returned. Items that
+// have expired are treated as not existing.
 func (tx *Tx) Set(key, value string, opts *SetOptions) (previousValue string,
 	replaced bool, err error) {
 	if tx.db == nil {
@@ -1086,39 +3145,200 @@ func (tx *Tx) Set(key, value string, opts *SetOptions) (previousValue string,
 	} else if !tx.writable {
 		return "", false, ErrTxNotWritable
 	}
+	if opts != nil && (opts.NX || opts.XX || opts.CAS) {
+		// Check the conditions against the current item.
+		cur := tx.db.get(key)
+		if cur != nil && cur.expired() {
+			cur = nil
+		}
+		if (opts.NX && cur != nil) || (opts.XX && cur == nil) ||
+			(opts.CAS && (cur == nil || cur.val != opts.PrevValue)) {
+			return "", false, ErrConditionFailed
+		}
+	}
 	item := &dbItem{key: key, val: value}
 	if opts != nil {
 		if opts.Expires {
 			// The caller is requesting that this item expires. Convert the
 			// TTL to an absolute time and bind it to the item.
-			item.opts = &dbItemOpts{ex: true, exat: time.Now().Add(opts.TTL)}
+			exat := opts.ExpiresAt
+			if exat.IsZero() {
+				exat = time.Now().Add(opts.TTL)
+			}
+			item.opts = &dbItemOpts{ex: true, exat: exat}
+			if opts.Sliding && opts.TTL > 0 {
+				item.opts.ttl = opts.TTL
+			}
 		}
 	}
+	if err := tx.evict(item); err != nil {
+		return "", false, err
+	}
+	prev := tx.setItem(item)
+	if prev != nil && !prev.expired() {
+		previousValue, replaced = prev.val, true
+	}
+	return previousValue, replaced, nil
+}
+
+// setItem inserts the item into the database and records the details that are
+// needed to commit or rollback the transaction. The previous item with the same
+// key is returned, or nil if there was no previous item.
+func (tx *Tx) setItem(item *dbItem) *dbItem {
+	key := item.key
 	// Insert the item into the keys tree.
 	prev := tx.db.insertIntoDatabase(item)
-	if prev == nil {
-		// An item with the same key did not previously exist. Let's create a
-		// rollback entry with a nil value. A nil value indicates that the
-		// entry should be deleted on rollback. When the value is *not* nil,
-		// that means the entry should be reverted.
-		tx.rollbacks[key] = nil
-	} else {
-		// A previous item already exists in the database. Let's create a
-		// rollback entry with the item as the value. We need to check the map
-		// to see if there isn't already an item that matches the same key.
-		if _, ok := tx.rollbacks[key]; !ok {
+	tx.remember(key, prev)
+	// We need to check the map to see if there isn't already an item that
+	// matches the same key. Only the first change of a key is reverted.
+	if _, ok := tx.rollbacks[key]; !ok {
+		if prev == nil {
+			// An item with the same key did not previously exist. Let's
+			// create a rollback entry with a nil value. A nil value
+			// indicates that the entry should be deleted on rollback. When
+			// the value is *not* nil, that means the entry should be
+			// reverted.
+			tx.rollbacks[key] = nil
+		} else {
+			// A previous item already exists in the database. Let's create
+			// a rollback entry with the item as the value.
 			tx.rollbacks[key] = prev
 		}
-		if !item.expired() {
-			previousValue, replaced = item.val, true
-		}
 	}
 	// For commits we simply assign the item to the map. We use this map to
 	// write the entry to disk.
 	if tx.db.persist {
 		tx.commits[key] = item
 	}
-	return previousValue, replaced, nil
+	delete(tx.expires, key)
+	delete(tx.refreshes, key)
+	return prev
+}
+
+// Expire sets the time-to-live of an existing item. The item will be evicted
+// once the ttl has elapsed. If the item does not exist or if the item has
+// expired then ErrNotFound is returned.
+func (tx *Tx) Expire(key string, ttl time.Duration) error {
+	return tx.ExpireAt(key, time.Now().Add(ttl))
+}
+
+// ExpireAt sets the absolute time when an existing item will be evicted. If
+// the item does not exist or if the item has expired then ErrNotFound is
+// returned.
+func (tx *Tx) ExpireAt(key string, at time.Time) error {
+	return tx.setExpire(key, &dbItemOpts{ex: true, exat: at})
+}
+
+// Persist removes the expiration of an existing item so that it will never be
+// evicted. If the item does not exist or if the item has expired then
+// ErrNotFound is returned.
+func (tx *Tx) Persist(key string) error {
+	return tx.setExpire(key, nil)
+}
+
+// setExpire replaces the options of an existing item with opts. Only the new
+// expiration, and not the value, is written to disk when the item has not
+// otherwise been changed by the transaction.
+func (tx *Tx) setExpire(key string, opts *dbItemOpts) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+	cur := tx.db.get(key)
+	if cur == nil || cur.expired() {
+		return ErrNotFound
+	}
+	if opts == nil && (cur.opts == nil || !cur.opts.ex) {
+		// Nothing to persist.
+		return nil
+	}
+	_, changed := tx.rollbacks[key]
+	expireOnly := !changed || tx.expires[key]
+	// The current item is never modified in place because it may be
+	// referenced by the exps tree and the rollbacks map.
+	item := &dbItem{key: key, val: cur.val, opts: opts}
+	if err := tx.evict(item); err != nil {
+		return err
+	}
+	tx.setItem(item)
+	if expireOnly {
+		tx.expires[key] = true
+	}
+	return nil
+}
+
+// SetIfValue replaces the value of an item only when the item exists and its
+// current value is equal to the old param. ErrConditionFailed is returned when
+// the item does not exist or has a different value.
+func (tx *Tx) SetIfValue(key, old, value string) error {
+	_, _, err := tx.Set(key, value, &SetOptions{CAS: true, PrevValue: old})
+	return err
+}
+
+// Incr increments the integer value of an item by delta and returns the new
+// value. An item that does not exist is treated as zero. The expiration of an
+// existing item is preserved. ErrNotNumber is returned when the value is not
+// an integer, and ErrInvalidOperation is returned when the result overflows.
+func (tx *Tx) Incr(key string, delta int64) (int64, error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	} else if !tx.writable {
+		return 0, ErrTxNotWritable
+	}
+	var n int64
+	item := &dbItem{key: key}
+	if cur := tx.db.get(key); cur != nil && !cur.expired() {
+		var err error
+		n, err = strconv.ParseInt(cur.val, 10, 64)
+		if err != nil {
+			return 0, &NotNumberError{Key: key, Value: cur.val}
+		}
+		item.opts = cur.opts.copy()
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) ||
+		(delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrInvalidOperation
+	}
+	n += delta
+	item.val = strconv.FormatInt(n, 10)
+	if err := tx.evict(item); err != nil {
+		return 0, err
+	}
+	tx.setItem(item)
+	return n, nil
+}
+
+// IncrFloat increments the float value of an item by delta and returns the new
+// value. An item that does not exist is treated as zero. The expiration of an
+// existing item is preserved. ErrNotNumber is returned when the value is not a
+// number, and ErrInvalidOperation is returned when the result is not finite.
+func (tx *Tx) IncrFloat(key string, delta float64) (float64, error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	} else if !tx.writable {
+		return 0, ErrTxNotWritable
+	}
+	var n float64
+	item := &dbItem{key: key}
+	if cur := tx.db.get(key); cur != nil && !cur.expired() {
+		var err error
+		n, err = strconv.ParseFloat(cur.val, 64)
+		if err != nil {
+			return 0, &NotNumberError{Key: key, Value: cur.val}
+		}
+		item.opts = cur.opts.copy()
+	}
+	n += delta
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, ErrInvalidOperation
+	}
+	item.val = strconv.FormatFloat(n, 'f', -1, 64)
+	if err := tx.evict(item); err != nil {
+		return 0, err
+	}
+	tx.setItem(item)
+	return n, nil
 }
 
 // Get returns a value for a key. If the item does not exist or if the item
@@ -1127,7 +3347,7 @@ func (tx *Tx) Get(key string) (val string, err error) {
 	if tx.db == nil {
 		return "", ErrTxClosed
 	}
-	item := tx.db.get(key)
+	item := tx.get(key)
 	if item == nil {
 		return "", ErrNotFound
 	}
@@ -1136,9 +3356,59 @@ func (tx *Tx) Get(key string) (val string, err error) {
 		// the caller is only interested in items that have not expired.
 		return "", ErrNotFound
 	}
+	if item.opts != nil && item.opts.ttl > 0 {
+		tx.touch(item)
+	}
+	if tx.snap.config.MaxMemory > 0 {
+		// Track the access for the LRU and LFU eviction policies.
+		atomic.StoreInt64(&item.atime, time.Now().UnixNano())
+		atomic.AddUint32(&item.hits, 1)
+	}
 	return item.val, nil
 }
 
+// touch extends the expiration of a sliding item. The item is not modified
+// beyond an atomic update of its last read time, which allows for calling
+// from read-only transactions. The new expiration is written to the exps tree
+// and to disk later by the background manager.
+func (tx *Tx) touch(item *dbItem) {
+	atomic.StoreInt64(&item.opts.touched, time.Now().UnixNano())
+	if db := tx.db; db.persist && !tx.snap.config.ReadOnly {
+		db.touchmu.Lock()
+		if db.touches == nil {
+			db.touches = make(map[string]bool)
+		}
+		db.touches[item.key] = true
+		db.touchmu.Unlock()
+	}
+}
+
+// slide replaces a sliding item with one that has the extended expiration of
+// the last read. Nothing happens when the item is not sliding or has expired.
+func (tx *Tx) slide(key string) error {
+	cur := tx.db.get(key)
+	if cur == nil || cur.opts == nil || cur.opts.ttl == 0 {
+		return nil
+	}
+	exat := cur.opts.deadline()
+	if !exat.After(cur.opts.exat) {
+		return nil
+	}
+	err := tx.setExpire(key, &dbItemOpts{ex: true, exat: exat,
+		ttl: cur.opts.ttl})
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// A refresh is not a change that watchers are interested in.
+	if tx.refreshes == nil {
+		tx.refreshes = make(map[string]bool)
+	}
+	tx.refreshes[key] = true
+	return nil
+}
+
 // Delete removes an item from the database based on the item's key. If the item
 // does not exist or if the item has expired then ErrNotFound is returned.
 //
@@ -1153,12 +3423,15 @@ func (tx *Tx) Delete(key string) (val string, err error) {
 	if item == nil {
 		return "", ErrNotFound
 	}
+	tx.remember(key, item)
 	if _, ok := tx.rollbacks[key]; !ok {
 		tx.rollbacks[key] = item
 	}
 	if tx.db.persist {
 		tx.commits[key] = nil
 	}
+	delete(tx.expires, key)
+	delete(tx.refreshes, key)
 	// Even though the item has been deleted, we still want to check
 	// if it has expired. An expired item should not be returned.
 	if item.expired() {
@@ -1169,6 +3442,51 @@ func (tx *Tx) Delete(key string) (val string, err error) {
 	return item.val, nil
 }
 
+// Apply makes a change that was returned by Changes() or ChangesSince(), such
+// as a change of another database that this database is a copy of. Unlike
+// Set(), no items are evicted and the MaxMemory limit is not checked, thus
+// applying the same changes to copies of a database gives the same contents
+// on every copy. A ChangeTTL of an item that does not exist is ignored.
+// ErrInvalidOperation is returned for an unknown type of change.
+func (tx *Tx) Apply(c Change) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+	switch c.Type {
+	case ChangeSet:
+		tx.setItem(changeItem(c))
+	case ChangeDelete:
+		if _, err := tx.Delete(c.Key); err == ErrNotFound {
+			if _, ok := tx.rollbacks[c.Key]; !ok {
+				// The item was created and deleted by the same
+				// transaction of the other database.
+				tx.rollbacks[c.Key] = nil
+				if tx.db.persist {
+					tx.commits[c.Key] = nil
+				}
+			}
+		}
+	case ChangeTTL:
+		cur := tx.db.get(c.Key)
+		if cur == nil {
+			return nil
+		}
+		item := changeItem(c)
+		item.val = cur.val
+		_, changed := tx.rollbacks[c.Key]
+		expireOnly := !changed || tx.expires[c.Key]
+		tx.setItem(item)
+		if expireOnly {
+			tx.expires[c.Key] = true
+		}
+	default:
+		return ErrInvalidOperation
+	}
+	return nil
+}
+
 // TTL returns the remaining time-to-live for an item.
 // A negative duration will be returned for items that do not have an
 // expiration.
@@ -1176,19 +3494,33 @@ func (tx *Tx) TTL(key string) (time.Duration, error) {
 	if tx.db == nil {
 		return 0, ErrTxClosed
 	}
-	item := tx.db.get(key)
+	item := tx.get(key)
 	if item == nil {
 		return 0, ErrNotFound
 	} else if item.opts == nil || !item.opts.ex {
 		return -1, nil
 	}
-	dur := item.opts.exat.Sub(time.Now())
+	dur := item.opts.deadline().Sub(time.Now())
 	if dur < 0 {
 		return 0, ErrNotFound
 	}
 	return dur, nil
 }
 
+// GetLess returns the less function of an index, which orders the values of
+// the items in the index. Items with equal values are ordered by the key.
+// ErrNotFound is returned when the index does not exist or is a spatial index.
+func (tx *Tx) GetLess(index string) (func(a, b string) bool, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+	idx := tx.snap.idxs[index]
+	if idx == nil || idx.less == nil {
+		return nil, ErrNotFound
+	}
+	return idx.less, nil
+}
+
 // scan iterates through a specified index and calls user-defined iterator
 // function for each item encountered.
 // The desc param indicates that the iterator should descend.
@@ -1206,16 +3538,20 @@ func (tx *Tx) scan(
 		return ErrTxClosed
 	}
 	// wrap a btree specific iterator around the user-defined iterator.
+	var err error
 	iter := func(item btree.Item) bool {
+		if err = tx.interrupted(); err != nil {
+			return false
+		}
 		dbi := item.(*dbItem)
 		return iterator(dbi.key, dbi.val)
 	}
 	var tr *btree.BTree
 	if index == "" {
 		// empty index means we will use the keys tree.
-		tr = tx.db.keys
+		tr = tx.snap.keys
 	} else {
-		idx := tx.db.idxs[index]
+		idx := tx.snap.idxs[index]
 		if idx == nil {
 			// index was not found. return error
 			return ErrNotFound
@@ -1228,8 +3564,16 @@ func (tx *Tx) scan(
 	// create some limit items
 	var itemA, itemB *dbItem
 	if gt || lt {
-		itemA = &dbItem{key: start}
-		itemB = &dbItem{key: stop}
+		if index == "" {
+			itemA = &dbItem{key: start}
+			itemB = &dbItem{key: stop}
+		} else {
+			// The index trees are ordered by the values. A descending
+			// scan includes all of the items that are equal to the
+			// lessOrEqual pivot.
+			itemA = &dbItem{val: start, keyless: desc}
+			itemB = &dbItem{val: stop, keyless: desc}
+		}
 	}
 	// execute the scan on the underlying tree.
 	if desc {
@@ -1257,7 +3601,7 @@ func (tx *Tx) scan(
 			tr.Ascend(iter)
 		}
 	}
-	return nil
+	return err
 }
 
 // Ascend calls the iterator for every item in the database within the range
@@ -1348,13 +3692,54 @@ func (tx *Tx) DescendRange(index, lessOrEqual, greaterThan string,
 	)
 }
 
-// rect is used by Intersects
-type rect struct {
-	min, max []float64
+// AscendKeys calls the iterator for every item in the database with a key
+// matching the pattern, ordered by the key, until iterator returns false. The
+// pattern uses the same syntax as index patterns, where '*' matches on any
+// number of characters and '?' matches on any one character.
+func (tx *Tx) AscendKeys(pattern string, iterator Iterator) error {
+	return tx.ascendKeys(pattern, "", false, iterator)
 }
 
-func (r *rect) Rect(ctx interface{}) (min, max []float64) {
-	return r.min, r.max
+// AscendKeysGreaterThan is like AscendKeys, but only calls the iterator for
+// the keys that are greater than pivot. It can be used to continue from the
+// last key of a previous call.
+func (tx *Tx) AscendKeysGreaterThan(pattern, pivot string,
+	iterator Iterator) error {
+	return tx.ascendKeys(pattern, pivot, true, iterator)
+}
+
+// ascendKeys is called by AscendKeys() and AscendKeysGreaterThan().
+func (tx *Tx) ascendKeys(pattern, pivot string, gt bool,
+	iterator Iterator) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	// Only the keys that begin with the literal prefix of the pattern need
+	// to be visited.
+	prefix := pattern
+	if i := strings.IndexAny(pattern, "*?"); i != -1 {
+		prefix = pattern[:i]
+	}
+	start := prefix
+	if gt && pivot > start {
+		start = pivot
+	}
+	var err error
+	tx.snap.keys.AscendGreaterOrEqual(&dbItem{key: start},
+		func(item btree.Item) bool {
+			if err = tx.interrupted(); err != nil {
+				return false
+			}
+			dbi := item.(*dbItem)
+			if !strings.HasPrefix(dbi.key, prefix) {
+				return false
+			}
+			if (gt && dbi.key == pivot) || !wildcardMatch(dbi.key, pattern) {
+				return true
+			}
+			return iterator(dbi.key, dbi.val)
+		})
+	return err
 }
 
 // Intersects searches for rectangle items that intersect a target rect.
@@ -1371,11 +3756,14 @@ func (tx *Tx) Intersects(index, bounds string, iterator Iterator) error {
 		return nil
 	}
 	// wrap a rtree specific iterator around the user-defined iterator.
-	iter := func(item rtree.Item) bool {
-		dbi := item.(*dbItem)
+	var err error
+	iter := func(dbi *dbItem) bool {
+		if err = tx.interrupted(); err != nil {
+			return false
+		}
 		return iterator(dbi.key, dbi.val)
 	}
-	idx := tx.db.idxs[index]
+	idx := tx.snap.idxs[index]
 	if idx == nil {
 		// index was not found. return error
 		return ErrNotFound
@@ -1389,8 +3777,8 @@ func (tx *Tx) Intersects(index, bounds string, iterator Iterator) error {
 	if idx.rect != nil {
 		min, max = idx.rect(bounds)
 	}
-	idx.rtr.Search(&rect{min, max}, iter)
-	return nil
+	idx.rtr.Search(min, max, iter)
+	return err
 }
 
 // Len returns the number of items in the database
@@ -1398,7 +3786,7 @@ func (tx *Tx) Len() (int, error) {
 	if tx.db == nil {
 		return 0, ErrTxClosed
 	}
-	return tx.db.keys.Len(), nil
+	return tx.snap.keys.Len(), nil
 }
 
 // Rect is helper function that returns a string representation
@@ -3,8 +3,10 @@ package buntdb
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -163,7 +165,7 @@ func TestVariousTx(t *testing.T) {
 				}
 			}
 		}()
-		return tx.commit()
+		return tx.Commit()
 	}); err != nil {
 		t.Fatal(err)
 	}
@@ -178,7 +180,7 @@ func TestVariousTx(t *testing.T) {
 				}
 			}
 		}()
-		return tx.rollback()
+		return tx.Rollback()
 	}); err != nil {
 		t.Fatal(err)
 	}
@@ -207,7 +209,6 @@ func TestVariousTx(t *testing.T) {
 	}); err != ErrTxClosed {
 		t.Fatal("expecting tx closed error")
 	}
-	db.mu.RUnlock()
 	// flush to unwritable file
 	if err := db.Update(func(tx *Tx) error {
 		_, _, err := tx.Set("var1", "val1", nil)
@@ -494,6 +495,7 @@ func TestDatabaseFormat(t *testing.T) {
 			"*3\r\n$3\r\nset\r\n$4\r\nvar2\r\n$4\r\n1234\r\n",
 			"*2\r\n$3\r\ndel\r\n$4\r\nvar1\r\n",
 			"*5\r\n$3\r\nset\r\n$3\r\nvar\r\n$3\r\nval\r\n$2\r\nex\r\n$2\r\n10\r\n",
+			"*5\r\n$3\r\nset\r\n$4\r\nvar3\r\n$3\r\nval\r\n$4\r\nexat\r\n$19\r\n4102444800000000000\r\n",
 		}, "")
 		if err := os.RemoveAll("data.db"); err != nil {
 			t.Fatal(err)
@@ -541,6 +543,7 @@ func TestDatabaseFormat(t *testing.T) {
 	testBadFormat("*1\r\n$3\r\nset\r\n")
 	testBadFormat("*5\r\n$3\r\nset\r\n$3\r\nvar\r\n$3\r\nval\r\n$2\r\nxx\r\n$2\r\n10\r\n")
 	testBadFormat("*5\r\n$3\r\nset\r\n$3\r\nvar\r\n$3\r\nval\r\n$2\r\nex\r\n$2\r\naa\r\n")
+	testBadFormat("*5\r\n$3\r\nset\r\n$3\r\nvar\r\n$3\r\nval\r\n$4\r\nexat\r\n$2\r\naa\r\n")
 }
 
 func TestInsertsAndDeleted(t *testing.T) {
@@ -1234,6 +1237,2509 @@ func TestConfig(t *testing.T) {
 		t.Fatalf("expecting %v, %v, and %v, got %v, %v, and %v", 100, 200, Always, c.AutoShrinkMinSize, c.AutoShrinkPercentage, c.SyncPolicy)
 	}
 }
+
+func TestManualTx(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = db.Close() }()
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tx.Set("key1", "val1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != ErrTxClosed {
+		t.Fatalf("expecting '%v', got '%v'", ErrTxClosed, err)
+	}
+	tx, err = db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tx.Set("key2", "val2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != ErrTxClosed {
+		t.Fatalf("expecting '%v', got '%v'", ErrTxClosed, err)
+	}
+	tx, err = db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tx.Set("key3", "val3", nil); err != ErrTxNotWritable {
+		t.Fatalf("expecting '%v', got '%v'", ErrTxNotWritable, err)
+	}
+	if val, err := tx.Get("key1"); err != nil || val != "val1" {
+		t.Fatalf("expecting '%v', got '%v' (%v)", "val1", val, err)
+	}
+	if _, err := tx.Get("key2"); err != ErrNotFound {
+		t.Fatalf("expecting '%v', got '%v'", ErrNotFound, err)
+	}
+	if err := tx.Commit(); err != ErrTxNotWritable {
+		t.Fatalf("expecting '%v', got '%v'", ErrTxNotWritable, err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Begin(false); err != ErrDatabaseClosed {
+		t.Fatalf("expecting '%v', got '%v'", ErrDatabaseClosed, err)
+	}
+	db, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpiresAtReload(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = db.Close() }()
+	var exat time.Time
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("key1", "val1", &SetOptions{Expires: true, TTL: time.Hour}); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("key2", "val2", &SetOptions{Expires: true, TTL: time.Millisecond * 500}); err != nil {
+			return err
+		}
+		exat = db.get("key1").opts.exat
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkReload := func() {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open("data.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.View(func(tx *Tx) error {
+			if item := db.get("key1"); item == nil || !item.opts.exat.Equal(exat) {
+				t.Fatalf("expecting '%v', got '%v'", exat, item)
+			}
+			if _, err := tx.Get("key2"); err != nil {
+				t.Fatal(err)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkReload()
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	checkReload()
+	time.Sleep(time.Millisecond * 600)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if _, err := tx.Get("key2"); err != ErrNotFound {
+			t.Fatalf("expecting '%v', got '%v'", ErrNotFound, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testIndexLessLen(a, b string) bool {
+	return len(a) < len(b)
+}
+
+func TestPersistIndexes(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = db.Close() }()
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("user:1:name", "tom", nil); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("user:2:name", "Janet", nil); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("fleet:1:pos", "[10 10]", nil); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("names", "user:*:name", IndexString); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSpatialIndex("fleet", "fleet:*:pos", IndexRect); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("temp", "*", func(a, b string) bool { return a < b }); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("lens", "*", testIndexLessLen); err != nil {
+		t.Fatal(err)
+	}
+	reopen := func(expect string) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open("data.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		idxs, err := db.Indexes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(idxs, ",") != expect {
+			t.Fatalf("expecting '%v', got '%v'", expect, strings.Join(idxs, ","))
+		}
+		if err := db.View(func(tx *Tx) error {
+			var vals []string
+			if err := tx.Ascend("names", func(key, val string) bool {
+				vals = append(vals, val)
+				return true
+			}); err != nil {
+				return err
+			}
+			if strings.Join(vals, ",") != "Janet,tom" {
+				t.Fatalf("expecting '%v', got '%v'", "Janet,tom", strings.Join(vals, ","))
+			}
+			var keys []string
+			if err := tx.Intersects("fleet", "[0 0],[20 20]", func(key, val string) bool {
+				keys = append(keys, key)
+				return true
+			}); err != nil {
+				return err
+			}
+			if strings.Join(keys, ",") != "fleet:1:pos" {
+				t.Fatalf("expecting '%v', got '%v'", "fleet:1:pos", strings.Join(keys, ","))
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// unregistered functions are not persisted.
+	reopen("fleet,names")
+	if err := db.DropIndex("fleet"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSpatialIndex("fleet", "fleet:*:pos", IndexRect); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	reopen("fleet,names")
+
+	// registered functions must be registered in order to reopen.
+	RegisterLess("testIndexLessLen", testIndexLessLen)
+	if err := db.CreateIndex("lens", "*", testIndexLessLen); err != nil {
+		t.Fatal(err)
+	}
+	reopen("fleet,lens,names")
+
+	// creating a rebuilt index again does nothing.
+	if err := db.CreateIndex("lens", "*", testIndexLessLen); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSpatialIndex("fleet", "fleet:*:pos", IndexRect); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("lens", "user:*", testIndexLessLen); err != ErrIndexExists {
+		t.Fatalf("expecting '%v', got '%v'", ErrIndexExists, err)
+	}
+	if err := db.CreateIndex("lens", "*", IndexString); err != ErrIndexExists {
+		t.Fatalf("expecting '%v', got '%v'", ErrIndexExists, err)
+	}
+	if err := db.CreateIndex("fleet", "fleet:*:pos", IndexString); err != ErrIndexExists {
+		t.Fatalf("expecting '%v', got '%v'", ErrIndexExists, err)
+	}
+	reopen("fleet,lens,names")
+
+	// the file references a function that is not registered.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile("data.db", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wr := bufio.NewWriter(f)
+	writeMultiBulk(wr, "createindex", "other", "*", "testUnregistered")
+	if err := wr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open("data.db")
+	if !errors.Is(err, ErrFuncNotRegistered) {
+		t.Fatalf("expecting '%v', got '%v'", ErrFuncNotRegistered, err)
+	}
+	if e, ok := err.(*FuncNotRegisteredError); !ok || e.Name != "testUnregistered" {
+		t.Fatalf("expecting '%v', got '%v'", "testUnregistered", err)
+	}
+	// the file is valid, and it can be read without the function
+	if _, err := Verify("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.ReadOnly = true
+	config.SkipUnregisteredIndexes = true
+	ro, err := OpenWithConfig("data.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ro.View(func(tx *Tx) error {
+		_, err := tx.GetLess("other")
+		return err
+	}); err != ErrNotFound {
+		t.Fatalf("expecting '%v', got '%v'", ErrNotFound, err)
+	}
+	// the definition is kept in a snapshot
+	var buf bytes.Buffer
+	if err := ro.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "testUnregistered") {
+		t.Fatalf("expecting '%v' in the snapshot", "testUnregistered")
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+	config.ReadOnly = false
+	if _, err := OpenWithConfig("data.db", config); !errors.Is(err, ErrFuncNotRegistered) {
+		t.Fatalf("expecting '%v', got '%v'", ErrFuncNotRegistered, err)
+	}
+	RegisterLess("testUnregistered", func(a, b string) bool { return a > b })
+	db, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"lens", "other"} {
+		if err := db.DropIndex(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopen("fleet,names")
+}
+
+func TestChecksumAndRecover(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = db.Close() }()
+	var config Config
+	if err := db.ReadConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	config.Checksum = true
+	if err := db.SetConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			if _, _, err := tx.Set(fmt.Sprintf("key:%d:a", i), "val", nil); err != nil {
+				return err
+			}
+			if _, _, err := tx.Set(fmt.Sprintf("key:%d:b", i), "val", nil); err != nil {
+				return err
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Recover("data.db"); err != nil || n != 0 {
+		t.Fatalf("expecting '%v', got '%v' (%v)", 0, n, err)
+	}
+	// torn write of the last transaction
+	if err := ioutil.WriteFile("data.db", data[:len(data)-10], 0666); err != nil {
+		t.Fatal(err)
+	}
+	n, err := Recover("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || n >= int64(len(data))/10 {
+		t.Fatalf("expecting the last transaction to be discarded, got '%v'", n)
+	}
+	db, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		n, err := tx.Len()
+		if err != nil {
+			return err
+		}
+		if n != 18 {
+			t.Fatalf("expecting '%v', got '%v'", 18, n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// corrupted transaction
+	data[len(data)-3] = 'x'
+	if err := ioutil.WriteFile("data.db", data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open("data.db"); err != ErrInvalid {
+		t.Fatalf("expecting '%v', got '%v'", ErrInvalid, err)
+	}
+	// the file is recovered on open
+	config = DefaultConfig()
+	config.AutoRecover = true
+	var discarded int64
+	config.OnRecover = func(n int64) { discarded = n }
+	db, err = OpenWithConfig("data.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if discarded == 0 {
+		t.Fatal("expecting the last transaction to be discarded")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Recover("data.db"); err != nil || n != 0 {
+		t.Fatalf("expecting '%v', got '%v' (%v)", 0, n, err)
+	}
+	// the size of a checksum batch is not trusted
+	f, err := os.OpenFile("data.db", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wr := bufio.NewWriter(f)
+	writeMultiBulk(wr, "checksum", "0", "4000000000")
+	writeMultiBulk(wr, "multi")
+	if err := wr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Verify("data.db"); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expecting '%v', got '%v' (%v)", io.ErrUnexpectedEOF, err, n)
+	}
+	db, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxFraming(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = db.Close() }()
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key0", "val0", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		for i := 1; i <= 5; i++ {
+			if _, _, err := tx.Set(fmt.Sprintf("key%d", i), "val", nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	full, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every partial write of the second transaction must be discarded.
+	for i := len(data) + 1; i < len(full); i++ {
+		if err := ioutil.WriteFile("data.db", full[:i], 0666); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open("data.db")
+		if err != nil {
+			t.Fatalf("at %v: %v", i, err)
+		}
+		if err := db.View(func(tx *Tx) error {
+			n, err := tx.Len()
+			if err != nil {
+				return err
+			}
+			if n != 1 {
+				t.Fatalf("at %v: expecting '%v', got '%v'", i, 1, n)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set("key6", "val", nil)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open("data.db")
+		if err != nil {
+			t.Fatalf("at %v: %v", i, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// unbalanced transactions are invalid.
+	testBadFormat := func(resp string) {
+		if err := ioutil.WriteFile("data.db", []byte(resp), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if db, err := Open("data.db"); err != ErrInvalid {
+			if err == nil {
+				_ = db.Close()
+			}
+			t.Fatalf("expecting '%v', got '%v'", ErrInvalid, err)
+		}
+	}
+	testBadFormat("*1\r\n$4\r\nexec\r\n")
+	testBadFormat("*1\r\n$5\r\nmulti\r\n*1\r\n$5\r\nmulti\r\n")
+	testBadFormat("*1\r\n$5\r\nmulti\r\n*1\r\n$3\r\nnop\r\n*1\r\n$4\r\nexec\r\n")
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenWithConfig(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	config := DefaultConfig()
+	config.SyncPolicy = SyncPolicy(3)
+	if _, err := OpenWithConfig("data.db", config); err != ErrInvalidSyncPolicy {
+		t.Fatalf("expecting '%v', got '%v'", ErrInvalidSyncPolicy, err)
+	}
+	config = DefaultConfig()
+	config.ReadOnly = true
+	if _, err := OpenWithConfig("data.db", config); !os.IsNotExist(err) {
+		t.Fatalf("expecting a not exist error, got '%v'", err)
+	}
+	config = Config{
+		SyncPolicy:         Always,
+		AutoShrinkDisabled: true,
+		FileMode:           0600,
+		BTreeDegree:        4,
+		BackgroundInterval: time.Millisecond * 50,
+	}
+	db, err := OpenWithConfig("data.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	fi, err := os.Stat("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		t.Fatalf("expecting no group or other permissions, got '%v'", fi.Mode().Perm())
+	}
+	if err := db.SetConfig(Config{SyncPolicy: Never}); err != nil {
+		t.Fatal(err)
+	}
+	var c Config
+	if err := db.ReadConfig(&c); err != nil {
+		t.Fatal(err)
+	}
+	if c.SyncPolicy != Never || c.FileMode != 0600 || c.BTreeDegree != 4 ||
+		c.BackgroundInterval != time.Millisecond*50 {
+		t.Fatalf("unexpected config '%+v'", c)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		for i := 0; i < 100; i++ {
+			if _, _, err := tx.Set(fmt.Sprintf("key:%03d", i), "val", nil); err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set("exp", "val", &SetOptions{Expires: true, TTL: time.Millisecond * 10})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the background interval is faster than the default one second.
+	time.Sleep(time.Millisecond * 200)
+	if err := db.View(func(tx *Tx) error {
+		n, err := tx.Len()
+		if err != nil {
+			return err
+		}
+		if n != 100 {
+			t.Fatalf("expecting '%v', got '%v'", 100, n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	config = DefaultConfig()
+	config.ReadOnly = true
+	db, err = OpenWithConfig("data.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error { return nil }); err != ErrTxNotWritable {
+		t.Fatalf("expecting '%v', got '%v'", ErrTxNotWritable, err)
+	}
+	if err := db.Shrink(); err != ErrInvalidOperation {
+		t.Fatalf("expecting '%v', got '%v'", ErrInvalidOperation, err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		n, err := tx.Len()
+		if err != nil {
+			return err
+		}
+		if n != 100 {
+			t.Fatalf("expecting '%v', got '%v'", 100, n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadOnlyTail(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	wdb, err := Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = wdb.Close() }()
+	if err := wdb.CreateIndex("vals", "*", IndexInt); err != nil {
+		t.Fatal(err)
+	}
+	set := func(key, val string) {
+		if err := wdb.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(key, val, nil)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("key1", "1")
+	rdb, err := OpenReadOnly("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rdb.Close() }()
+	config := DefaultConfig()
+	config.ReadOnly = true
+	config.Tail = true
+	config.BackgroundInterval = time.Millisecond * 10
+	tdb, err := OpenWithConfig("data.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tdb.Close() }()
+	if err := rdb.Update(func(tx *Tx) error { return nil }); err != ErrTxNotWritable {
+		t.Fatalf("expecting '%v', got '%v'", ErrTxNotWritable, err)
+	}
+	if _, err := rdb.Begin(true); err != ErrTxNotWritable {
+		t.Fatalf("expecting '%v', got '%v'", ErrTxNotWritable, err)
+	}
+	vals := func(db *DB) string {
+		var vals []string
+		if err := db.View(func(tx *Tx) error {
+			return tx.Ascend("vals", func(key, val string) bool {
+				vals = append(vals, val)
+				return true
+			})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(vals, ",")
+	}
+	set("key2", "2")
+	set("key3", "-3")
+	time.Sleep(time.Millisecond * 100)
+	if v := vals(rdb); v != "1" {
+		t.Fatalf("expecting '%v', got '%v'", "1", v)
+	}
+	if v := vals(tdb); v != "-3,1,2" {
+		t.Fatalf("expecting '%v', got '%v'", "-3,1,2", v)
+	}
+	if err := wdb.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	set("key4", "4")
+	time.Sleep(time.Millisecond * 100)
+	if v := vals(tdb); v != "-3,1,2,4" {
+		t.Fatalf("expecting '%v', got '%v'", "-3,1,2,4", v)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	if err := db.CreateIndex("vals", "*", IndexInt); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		for i := 0; i < 1000; i++ {
+			if _, _, err := tx.Set(fmt.Sprintf("key:%04d", i), strconv.Itoa(1000-i), nil); err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set("exp", "0", &SetOptions{Expires: true, TTL: time.Hour})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := db.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+	check := func(db *DB) {
+		if err := db.View(func(tx *Tx) error {
+			n, err := tx.Len()
+			if err != nil {
+				return err
+			}
+			if n != 1001 {
+				t.Fatalf("expecting '%v', got '%v'", 1001, n)
+			}
+			var first string
+			if err := tx.Ascend("vals", func(key, val string) bool {
+				first = key
+				return false
+			}); err != nil {
+				return err
+			}
+			if first != "exp" {
+				t.Fatalf("expecting '%v', got '%v'", "exp", first)
+			}
+			ttl, err := tx.TTL("exp")
+			if err != nil {
+				return err
+			}
+			if ttl <= time.Minute*59 {
+				t.Fatalf("expecting about an hour, got '%v'", ttl)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// load into a database that persists to disk.
+	db2, err := Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = db2.Close() }()
+	if err := db2.Load(bytes.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+	check(db2)
+	if err := db2.Load(bytes.NewReader(snapshot)); err != ErrInvalidOperation {
+		t.Fatalf("expecting '%v', got '%v'", ErrInvalidOperation, err)
+	}
+	if err := db2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db2, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db2)
+	// a snapshot is a valid database file.
+	if err := db2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("data.db", snapshot, 0666); err != nil {
+		t.Fatal(err)
+	}
+	db2, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db2)
+	// an incomplete snapshot leaves the database empty.
+	db3, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db3.Close() }()
+	if err := db3.Load(bytes.NewReader(snapshot[:len(snapshot)-5])); err == nil {
+		t.Fatal("expecting an error")
+	}
+	if err := db3.View(func(tx *Tx) error {
+		n, err := tx.Len()
+		if err != nil {
+			return err
+		}
+		if n != 0 {
+			t.Fatalf("expecting '%v', got '%v'", 0, n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db3.Load(bytes.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+	check(db3)
+}
+
+func TestSetPreviousValue(t *testing.T) {
+	db, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	if err := db.Update(func(tx *Tx) error {
+		for _, test := range []struct {
+			key, val string
+			opts     *SetOptions
+			prev     string
+			replaced bool
+		}{
+			{"a", "1", nil, "", false},
+			{"a", "2", nil, "1", true},
+			{"a", "3", &SetOptions{Expires: true, TTL: -time.Second}, "2", true},
+			// the previous item has expired
+			{"a", "4", nil, "", false},
+		} {
+			prev, replaced, err := tx.Set(test.key, test.val, test.opts)
+			if err != nil {
+				return err
+			}
+			if prev != test.prev || replaced != test.replaced {
+				t.Fatalf("expecting '%v %v', got '%v %v'",
+					test.prev, test.replaced, prev, replaced)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConditionalSet(t *testing.T) {
+	db, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("key1", "val1", &SetOptions{XX: true}); err != ErrConditionFailed {
+			t.Fatalf("expecting '%v', got '%v'", ErrConditionFailed, err)
+		}
+		if _, _, err := tx.Set("key1", "val1", &SetOptions{NX: true}); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("key1", "val2", &SetOptions{NX: true}); err != ErrConditionFailed {
+			t.Fatalf("expecting '%v', got '%v'", ErrConditionFailed, err)
+		}
+		prev, replaced, err := tx.Set("key1", "val2", &SetOptions{XX: true})
+		if err != nil {
+			return err
+		}
+		if prev != "val1" || !replaced {
+			t.Fatalf("expecting '%v', got '%v'", "val1", prev)
+		}
+		if _, _, err := tx.Set("key1", "val3", &SetOptions{CAS: true, PrevValue: "val1"}); err != ErrConditionFailed {
+			t.Fatalf("expecting '%v', got '%v'", ErrConditionFailed, err)
+		}
+		if _, _, err := tx.Set("key1", "val3", &SetOptions{CAS: true, PrevValue: "val2"}); err != nil {
+			return err
+		}
+		if err := tx.SetIfValue("key1", "val2", "val4"); err != ErrConditionFailed {
+			t.Fatalf("expecting '%v', got '%v'", ErrConditionFailed, err)
+		}
+		if err := tx.SetIfValue("key1", "val3", "val4"); err != nil {
+			return err
+		}
+		if err := tx.SetIfValue("key2", "", "val"); err != ErrConditionFailed {
+			t.Fatalf("expecting '%v', got '%v'", ErrConditionFailed, err)
+		}
+		if val, err := tx.Get("key1"); err != nil || val != "val4" {
+			t.Fatalf("expecting '%v', got '%v' (%v)", "val4", val, err)
+		}
+		// expired items do not exist.
+		if _, _, err := tx.Set("key3", "val", &SetOptions{Expires: true, TTL: -time.Second}); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("key3", "val", &SetOptions{XX: true}); err != ErrConditionFailed {
+			t.Fatalf("expecting '%v', got '%v'", ErrConditionFailed, err)
+		}
+		prev, replaced, err = tx.Set("key3", "val", &SetOptions{NX: true})
+		if err != nil {
+			return err
+		}
+		if prev != "" || replaced {
+			t.Fatalf("expecting '%v', got '%v'", "", prev)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = db.Close() }()
+	if err := db.Update(func(tx *Tx) error {
+		if n, err := tx.Incr("counter", 5); err != nil || n != 5 {
+			t.Fatalf("expecting '%v', got '%v' (%v)", 5, n, err)
+		}
+		if n, err := tx.Incr("counter", -7); err != nil || n != -2 {
+			t.Fatalf("expecting '%v', got '%v' (%v)", -2, n, err)
+		}
+		if _, _, err := tx.Set("ttl", "10", &SetOptions{Expires: true, TTL: time.Hour}); err != nil {
+			return err
+		}
+		prev := tx.get("ttl")
+		if n, err := tx.Incr("ttl", 1); err != nil || n != 11 {
+			t.Fatalf("expecting '%v', got '%v' (%v)", 11, n, err)
+		}
+		// the new item does not share the options of the previous item
+		if opts := tx.get("ttl").opts; opts == prev.opts || *opts != *prev.opts {
+			t.Fatalf("expecting a copy of '%+v', got '%+v'", *prev.opts, *opts)
+		}
+		if ttl, err := tx.TTL("ttl"); err != nil || ttl < time.Minute*59 {
+			t.Fatalf("expecting about an hour, got '%v' (%v)", ttl, err)
+		}
+		if _, _, err := tx.Set("str", "hello", nil); err != nil {
+			return err
+		}
+		for _, incr := range []func() error{
+			func() error { _, err := tx.Incr("str", 1); return err },
+			func() error { _, err := tx.IncrFloat("str", 1); return err },
+		} {
+			err := incr()
+			if !errors.Is(err, ErrNotNumber) {
+				t.Fatalf("expecting '%v', got '%v'", ErrNotNumber, err)
+			}
+			if e, ok := err.(*NotNumberError); !ok || e.Key != "str" || e.Value != "hello" {
+				t.Fatalf("expecting '%v', got '%#v'", "str=hello", err)
+			}
+		}
+		if _, _, err := tx.Set("max", strconv.FormatInt(1<<63-1, 10), nil); err != nil {
+			return err
+		}
+		if _, err := tx.Incr("max", 1); err != ErrInvalidOperation {
+			t.Fatalf("expecting '%v', got '%v'", ErrInvalidOperation, err)
+		}
+		if n, err := tx.IncrFloat("float", 1.5); err != nil || n != 1.5 {
+			t.Fatalf("expecting '%v', got '%v' (%v)", 1.5, n, err)
+		}
+		if n, err := tx.IncrFloat("float", -0.25); err != nil || n != 1.25 {
+			t.Fatalf("expecting '%v', got '%v' (%v)", 1.25, n, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// a rolled back increment is reverted.
+	errBroken := errors.New("broken")
+	if err := db.Update(func(tx *Tx) error {
+		if _, err := tx.Incr("counter", 100); err != nil {
+			return err
+		}
+		return errBroken
+	}); err != errBroken {
+		t.Fatalf("expecting '%v', got '%v'", errBroken, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if val, err := tx.Get("counter"); err != nil || val != "-2" {
+			t.Fatalf("expecting '%v', got '%v' (%v)", "-2", val, err)
+		}
+		if val, err := tx.Get("float"); err != nil || val != "1.25" {
+			t.Fatalf("expecting '%v', got '%v' (%v)", "1.25", val, err)
+		}
+		if ttl, err := tx.TTL("ttl"); err != nil || ttl < time.Minute*59 {
+			t.Fatalf("expecting about an hour, got '%v' (%v)", ttl, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnExpired(t *testing.T) {
+	config := DefaultConfig()
+	config.BackgroundInterval = time.Millisecond * 20
+	var db *DB
+	expired := make(chan string, 10)
+	config.OnExpired = func(key, val string) {
+		// opening a transaction from here must not deadlock.
+		if err := db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set("expired:"+key, val, nil)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		expired <- key
+	}
+	extended := 0
+	config.OnExpiredSync = func(key, val string, tx *Tx) error {
+		if key == "extend" && extended == 0 {
+			extended++
+			_, _, err := tx.Set(key, val, &SetOptions{Expires: true, TTL: time.Millisecond * 50})
+			return err
+		}
+		return nil
+	}
+	var err error
+	db, err = OpenWithConfig(":memory:", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	if err := db.Update(func(tx *Tx) error {
+		opts := &SetOptions{Expires: true, TTL: time.Millisecond * 10}
+		if _, _, err := tx.Set("session", "1", opts); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("extend", "2", opts); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("forever", "3", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for len(keys) < 2 {
+		select {
+		case key := <-expired:
+			keys = append(keys, key)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout, got '%v'", keys)
+		}
+	}
+	if strings.Join(keys, ",") != "session,extend" {
+		t.Fatalf("expecting '%v', got '%v'", "session,extend", strings.Join(keys, ","))
+	}
+	if extended != 1 {
+		t.Fatalf("expecting '%v', got '%v'", 1, extended)
+	}
+	if err := db.View(func(tx *Tx) error {
+		var keys []string
+		if err := tx.Ascend("", func(key, val string) bool {
+			keys = append(keys, key)
+			return true
+		}); err != nil {
+			return err
+		}
+		if strings.Join(keys, ",") != "expired:extend,expired:session,forever" {
+			t.Fatalf("unexpected keys '%v'", strings.Join(keys, ","))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpireAndPersist(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = db.Close() }()
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	err = db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("a", "1", nil); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("b", "2", &SetOptions{Expires: true,
+			ExpiresAt: at}); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("c", "3", &SetOptions{Expires: true,
+			TTL: time.Hour})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rollback must restore the original expirations
+	err = db.Update(func(tx *Tx) error {
+		if err := tx.Expire("a", time.Minute); err != nil {
+			return err
+		}
+		if err := tx.Persist("b"); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	if err == nil || err.Error() != "rollback" {
+		t.Fatalf("expecting '%v', got '%v'", "rollback", err)
+	}
+	err = db.View(func(tx *Tx) error {
+		if ttl, _ := tx.TTL("a"); ttl >= 0 {
+			t.Fatalf("expecting '%v', got '%v'", "no ttl", ttl)
+		}
+		if ttl, _ := tx.TTL("b"); ttl <= 0 {
+			t.Fatalf("expecting '%v', got '%v'", "ttl", ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		if err := tx.ExpireAt("a", at); err != nil {
+			return err
+		}
+		if err := tx.Persist("b"); err != nil {
+			return err
+		}
+		if err := tx.Expire("c", time.Millisecond); err != nil {
+			return err
+		}
+		if err := tx.Persist("d"); err != ErrNotFound {
+			t.Fatalf("expecting '%v', got '%v'", ErrNotFound, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the expirations are written to the aof
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "$8\r\nexpireat\r\n$1\r\na\r\n") ||
+		!strings.Contains(string(data), "$7\r\npersist\r\n$1\r\nb\r\n") {
+		t.Fatalf("expecting expireat and persist records, got %q", data)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		if ttl, _ := tx.TTL("a"); ttl <= 0 || ttl > time.Hour {
+			t.Fatalf("expecting '%v', got '%v'", "ttl", ttl)
+		}
+		if ttl, _ := tx.TTL("b"); ttl >= 0 {
+			t.Fatalf("expecting '%v', got '%v'", "no ttl", ttl)
+		}
+		if _, err := tx.Get("c"); err != ErrNotFound {
+			t.Fatalf("expecting '%v', got '%v'", ErrNotFound, err)
+		}
+		if err := tx.Expire("c", time.Hour); err != ErrNotFound {
+			t.Fatalf("expecting '%v', got '%v'", ErrNotFound, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.BackgroundInterval = time.Millisecond * 20
+	db, err := OpenWithConfig("data.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = db.Close() }()
+	err = db.Update(func(tx *Tx) error {
+		opts := &SetOptions{Expires: true, TTL: time.Millisecond * 200,
+			Sliding: true}
+		if _, _, err := tx.Set("session", "1", opts); err != nil {
+			return err
+		}
+		opts = &SetOptions{Expires: true, TTL: time.Millisecond * 200}
+		_, _, err := tx.Set("fixed", "2", opts)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reading the item keeps it alive well past the original ttl
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Millisecond * 50)
+		err = db.View(func(tx *Tx) error {
+			_, err := tx.Get("session")
+			return err
+		})
+		if err != nil {
+			t.Fatalf("read %d: expecting '%v', got '%v'", i, nil, err)
+		}
+	}
+	err = db.View(func(tx *Tx) error {
+		if _, err := tx.Get("fixed"); err != ErrNotFound {
+			t.Fatalf("expecting '%v', got '%v'", ErrNotFound, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	// the refresh is persisted along with the sliding ttl
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "$7\r\nsliding\r\n$9\r\n200000000\r\n") {
+		t.Fatalf("expecting sliding records, got %q", data)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithConfig("data.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx *Tx) error {
+		_, err := tx.Get("session")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without reads the item expires
+	time.Sleep(time.Millisecond * 300)
+	err = db.View(func(tx *Tx) error {
+		if _, err := tx.Get("session"); err != ErrNotFound {
+			t.Fatalf("expecting '%v', got '%v'", ErrNotFound, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx *Tx) error {
+		if n, err := tx.Len(); err != nil || n != 0 {
+			t.Fatalf("expecting '%v', got '%v'", 0, n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	open := func(policy EvictionPolicy) *DB {
+		if err := os.RemoveAll("data.db"); err != nil {
+			t.Fatal(err)
+		}
+		config := DefaultConfig()
+		config.MaxMemory = 10 * (itemOverhead + 10)
+		config.EvictionPolicy = policy
+		db, err := OpenWithConfig("data.db", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	set := func(db *DB, key string, opts *SetOptions) error {
+		return db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(key, "value", opts)
+			return err
+		})
+	}
+	exists := func(db *DB, key string) bool {
+		var ok bool
+		_ = db.View(func(tx *Tx) error {
+			_, err := tx.Get(key)
+			ok = err == nil
+			return nil
+		})
+		return ok
+	}
+	config := DefaultConfig()
+	config.EvictionPolicy = 10
+	if _, err := OpenWithConfig("data.db", config); err != ErrInvalidEvictionPolicy {
+		t.Fatalf("expecting '%v', got '%v'", ErrInvalidEvictionPolicy, err)
+	}
+
+	// noeviction
+	db := open(NoEviction)
+	for i := 0; i < 10; i++ {
+		if err := set(db, fmt.Sprintf("key:%d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := set(db, "key:a", nil); err != ErrOutOfMemory {
+		t.Fatalf("expecting '%v', got '%v'", ErrOutOfMemory, err)
+	}
+	// replacing an item with one of the same size is ok
+	if err := set(db, "key:0", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.MemoryUsage(); err != nil || n != 10*(itemOverhead+10) {
+		t.Fatalf("expecting '%v', got '%v'", 10*(itemOverhead+10), n)
+	}
+	// index entries are included
+	if err := db.CreateIndex("vals", "key:1*", IndexString); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := db.MemoryUsage(); n != 10*(itemOverhead+10)+indexOverhead {
+		t.Fatalf("expecting '%v', got '%v'",
+			10*(itemOverhead+10)+indexOverhead, n)
+	}
+	if err := db.DropIndex("vals"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := db.MemoryUsage(); n != 10*(itemOverhead+10) {
+		t.Fatalf("expecting '%v', got '%v'", 10*(itemOverhead+10), n)
+	}
+	// increments and expirations are limited as well
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("key:0", "1", nil); err != nil {
+			return err
+		}
+		if _, err := tx.Incr("key:0", 9999); err != nil {
+			return err
+		}
+		if _, err := tx.Incr("key:0", 90000); err != ErrOutOfMemory {
+			t.Fatalf("expecting '%v', got '%v'", ErrOutOfMemory, err)
+		}
+		if _, err := tx.IncrFloat("key:0", 0.5); err != ErrOutOfMemory {
+			t.Fatalf("expecting '%v', got '%v'", ErrOutOfMemory, err)
+		}
+		return tx.Expire("key:0", time.Hour)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the limit was lowered
+	var cfg Config
+	if err := db.ReadConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.MaxMemory--
+	if err := db.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		return tx.Persist("key:0")
+	}); err != ErrOutOfMemory {
+		t.Fatalf("expecting '%v', got '%v'", ErrOutOfMemory, err)
+	}
+	_ = db.Close()
+
+	// allkeys-lru
+	db = open(AllKeysLRU)
+	for i := 0; i < 10; i++ {
+		if err := set(db, fmt.Sprintf("key:%d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !exists(db, "key:0") {
+		t.Fatal("expecting key:0")
+	}
+	if err := set(db, "key:a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(db, "key:0") || exists(db, "key:1") || !exists(db, "key:a") {
+		t.Fatal("expecting key:1 to be evicted")
+	}
+	// the eviction is written to the aof
+	_ = db.Close()
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "$3\r\ndel\r\n$5\r\nkey:1\r\n") {
+		t.Fatalf("expecting del record, got %q", data)
+	}
+
+	// allkeys-lfu
+	db = open(AllKeysLFU)
+	for i := 0; i < 10; i++ {
+		if err := set(db, fmt.Sprintf("key:%d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 10-i; j++ {
+			exists(db, fmt.Sprintf("key:%d", i))
+		}
+	}
+	if err := set(db, "key:a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if exists(db, "key:9") || !exists(db, "key:8") {
+		t.Fatal("expecting key:9 to be evicted")
+	}
+	_ = db.Close()
+
+	// volatile-ttl and volatile-lru
+	for _, policy := range []EvictionPolicy{VolatileTTL, VolatileLRU} {
+		db = open(policy)
+		for i := 0; i < 9; i++ {
+			if err := set(db, fmt.Sprintf("key:%d", i), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		opts := &SetOptions{Expires: true, TTL: time.Hour}
+		if err := set(db, "key:9", opts); err != nil {
+			t.Fatal(err)
+		}
+		if err := set(db, "key:a", nil); err != nil {
+			t.Fatal(err)
+		}
+		if exists(db, "key:9") {
+			t.Fatal("expecting key:9 to be evicted")
+		}
+		// only items that expire may be evicted
+		if err := set(db, "key:b", nil); err != ErrOutOfMemory {
+			t.Fatalf("expecting '%v', got '%v'", ErrOutOfMemory, err)
+		}
+		_ = db.Close()
+	}
+}
+
+func TestWatch(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.BackgroundInterval = time.Millisecond * 10
+	db, err := OpenWithConfig("data.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = db.Close() }()
+	events, cancel := db.Watch("user:*")
+	next := func() Event {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+		return Event{}
+	}
+	err = db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("user:2", "b", nil); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("user:1", "a", nil); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("post:1", "p", nil); err != nil {
+			return err
+		}
+		// not sent, inserted and deleted
+		if _, _, err := tx.Set("user:3", "c", nil); err != nil {
+			return err
+		}
+		_, err := tx.Delete("user:3")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rolled back changes are not sent
+	_ = db.Update(func(tx *Tx) error {
+		_, _, _ = tx.Set("user:1", "x", nil)
+		return errors.New("rollback")
+	})
+	err = db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("user:1", "aa", nil); err != nil {
+			return err
+		}
+		if _, err := tx.Delete("user:2"); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("user:4", "d", &SetOptions{Expires: true,
+			TTL: time.Millisecond})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Event{
+		{Type: EventSet, Key: "user:1", New: "a"},
+		{Type: EventSet, Key: "user:2", New: "b"},
+		{Type: EventSet, Key: "user:1", Old: "a", New: "aa"},
+		{Type: EventDelete, Key: "user:2", Old: "b"},
+		{Type: EventSet, Key: "user:4", New: "d"},
+		{Type: EventExpire, Key: "user:4", Old: "d"},
+	}
+	for _, exp := range expect {
+		if ev := next(); ev != exp {
+			t.Fatalf("expecting '%v', got '%v'", exp, ev)
+		}
+	}
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("expecting closed channel")
+	}
+	cancel()
+
+	// slow consumers are dropped
+	events, cancel = db.Watch("*")
+	defer cancel()
+	err = db.Update(func(tx *Tx) error {
+		for i := 0; i < WatchBufferSize+1; i++ {
+			_, _, err := tx.Set(fmt.Sprintf("key:%04d", i), "v", nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for range events {
+		n++
+	}
+	if n != WatchBufferSize {
+		t.Fatalf("expecting '%v', got '%v'", WatchBufferSize, n)
+	}
+
+	// closing the database closes the channels
+	events, _ = db.Watch("*")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("expecting closed channel")
+	}
+	events, _ = db.Watch("*")
+	if _, ok := <-events; ok {
+		t.Fatal("expecting closed channel")
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.ChangeRingSize = 3
+	db, err := OpenWithConfig("data.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = db.Close() }()
+	at := time.Unix(0, time.Now().Add(time.Hour).UnixNano())
+	txs := []func(tx *Tx) error{
+		func(tx *Tx) error {
+			if _, _, err := tx.Set("b", "1", nil); err != nil {
+				return err
+			}
+			_, _, err := tx.Set("a", "1", nil)
+			return err
+		},
+		func(tx *Tx) error {
+			_, _, err := tx.Set("a", "2", &SetOptions{Expires: true,
+				ExpiresAt: at})
+			return err
+		},
+		func(tx *Tx) error {
+			_, err := tx.Delete("b")
+			return err
+		},
+		func(tx *Tx) error {
+			return tx.Persist("a")
+		},
+	}
+	for _, fn := range txs {
+		if err := db.Update(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// read-only and empty transactions do not have a sequence number
+	_ = db.Update(func(tx *Tx) error { return nil })
+	if seq, err := db.Seq(); err != nil || seq != 4 {
+		t.Fatalf("expecting '%v', got '%v'", 4, seq)
+	}
+	expect := []Change{
+		{Seq: 1, Type: ChangeSet, Key: "a", Value: "1"},
+		{Seq: 1, Type: ChangeSet, Key: "b", Value: "1"},
+		{Seq: 2, Type: ChangeSet, Key: "a", Value: "2", ExpiresAt: at},
+		{Seq: 3, Type: ChangeDelete, Key: "b"},
+		{Seq: 4, Type: ChangeTTL, Key: "a"},
+	}
+	check := func(seq uint64, expect []Change) {
+		t.Helper()
+		var changes []Change
+		err := db.ChangesSince(seq, func(c Change) bool {
+			changes = append(changes, c)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != len(expect) {
+			t.Fatalf("expecting '%v', got '%v'", expect, changes)
+		}
+		for i := range changes {
+			// The order of the changes in a transaction is not defined.
+			var found bool
+			for j := range expect {
+				if changes[i].Seq == expect[j].Seq &&
+					changes[i].Type == expect[j].Type &&
+					changes[i].Key == expect[j].Key &&
+					changes[i].Value == expect[j].Value &&
+					changes[i].ExpiresAt.Equal(expect[j].ExpiresAt) &&
+					changes[i].TTL == expect[j].TTL {
+					found = true
+				}
+			}
+			if !found || (i > 0 && changes[i].Seq < changes[i-1].Seq) {
+				t.Fatalf("expecting '%v', got '%v'", expect, changes)
+			}
+		}
+	}
+	check(0, expect)     // from the file
+	check(1, expect[2:]) // from the ring
+	check(4, nil)
+	var n int
+	err = db.ChangesSince(0, func(c Change) bool {
+		n++
+		return false
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("expecting '%v', got '%v'", 1, n)
+	}
+
+	// the sequence and the history survive a reload
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithConfig("data.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq, err := db.Seq(); err != nil || seq != 4 {
+		t.Fatalf("expecting '%v', got '%v'", 4, seq)
+	}
+	check(0, expect)
+	if err := db.Update(txs[0]); err != nil {
+		t.Fatal(err)
+	}
+	check(4, []Change{
+		{Seq: 5, Type: ChangeSet, Key: "a", Value: "1"},
+		{Seq: 5, Type: ChangeSet, Key: "b", Value: "1"},
+	})
+
+	// the history is removed by a shrink
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithConfig("data.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq, err := db.Seq(); err != nil || seq != 5 {
+		t.Fatalf("expecting '%v', got '%v'", 5, seq)
+	}
+	err = db.ChangesSince(4, func(c Change) bool { return true })
+	if err != ErrCompacted {
+		t.Fatalf("expecting '%v', got '%v'", ErrCompacted, err)
+	}
+	if err := db.Update(txs[2]); err != nil {
+		t.Fatal(err)
+	}
+	check(5, []Change{{Seq: 6, Type: ChangeDelete, Key: "b"}})
+
+	// the sliding ttl of an item, from the ring and from the file
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("s", "1", &SetOptions{Expires: true,
+			ExpiresAt: at, TTL: time.Hour, Sliding: true})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(txs[0]); err != nil {
+		t.Fatal(err)
+	}
+	sliding := Change{Seq: 7, Type: ChangeSet, Key: "s", Value: "1",
+		ExpiresAt: at, TTL: time.Hour}
+	check(6, []Change{sliding,
+		{Seq: 8, Type: ChangeSet, Key: "a", Value: "1"},
+		{Seq: 8, Type: ChangeSet, Key: "b", Value: "1"},
+	})
+	check(5, []Change{{Seq: 6, Type: ChangeDelete, Key: "b"}, sliding,
+		{Seq: 8, Type: ChangeSet, Key: "a", Value: "1"},
+		{Seq: 8, Type: ChangeSet, Key: "b", Value: "1"},
+	})
+	if err := db.Update(func(tx *Tx) error {
+		if _, err := tx.Delete("s"); err != nil {
+			return err
+		}
+		return tx.Apply(sliding)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if item := db.get("s"); item == nil || item.opts == nil ||
+		item.opts.ttl != time.Hour {
+		t.Fatalf("expecting a sliding ttl of '%v'", time.Hour)
+	}
+
+	// the changes of a transaction that is not committed
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("c", "1", nil); err != nil {
+			return err
+		}
+		changes, err := tx.Changes()
+		if err != nil {
+			return err
+		}
+		if len(changes) != 1 || changes[0].Seq != 0 || changes[0].Key != "c" {
+			t.Fatalf("expecting '%v', got '%v'", "c", changes)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		_, err := tx.Changes()
+		return err
+	}); err != ErrTxNotWritable {
+		t.Fatalf("expecting '%v', got '%v'", ErrTxNotWritable, err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxMemory = 1
+	db, err := OpenWithConfig(":memory:", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	at := time.Now().Add(time.Hour)
+	changes := []Change{
+		{Type: ChangeSet, Key: "a", Value: "1"},
+		{Type: ChangeSet, Key: "b", Value: "2"},
+		{Type: ChangeTTL, Key: "a", ExpiresAt: at},
+		{Type: ChangeDelete, Key: "b"},
+		{Type: ChangeTTL, Key: "missing", ExpiresAt: at},
+		{Type: ChangeDelete, Key: "missing"},
+	}
+	// the changes do not evict items or fail for the memory limit
+	if err := db.Update(func(tx *Tx) error {
+		for _, c := range changes {
+			if err := tx.Apply(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if val, err := tx.Get("a"); err != nil || val != "1" {
+			t.Fatalf("expecting '%v', got '%v' (%v)", "1", val, err)
+		}
+		if ttl, err := tx.TTL("a"); err != nil || ttl < time.Minute*59 {
+			t.Fatalf("expecting about an hour, got '%v' (%v)", ttl, err)
+		}
+		for _, key := range []string{"b", "missing"} {
+			if _, err := tx.Get(key); err != ErrNotFound {
+				t.Fatalf("expecting '%v', got '%v'", ErrNotFound, err)
+			}
+		}
+		if err := tx.Apply(changes[0]); err != ErrTxNotWritable {
+			t.Fatalf("expecting '%v', got '%v'", ErrTxNotWritable, err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		return tx.Apply(Change{Type: 10, Key: "a"})
+	}); err != ErrInvalidOperation {
+		t.Fatalf("expecting '%v', got '%v'", ErrInvalidOperation, err)
+	}
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	db, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	if err := db.CreateIndex("vals", "?", IndexInt); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSpatialIndex("pts", "pt:*", IndexRect); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("a", "1", nil); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("pt:1", "[1 1]", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// dump returns the items of a read-only transaction by each index.
+	dump := func(tx *Tx) string {
+		var items []string
+		for _, index := range []string{"", "vals"} {
+			if err := tx.Ascend(index, func(key, val string) bool {
+				items = append(items, key+"="+val)
+				return true
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Intersects("pts", "[0 0],[9 9]", func(key, val string) bool {
+			items = append(items, key)
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		n, err := tx.Len()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%s %d", strings.Join(items, ","), n)
+	}
+	rtx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := dump(rtx)
+	if before != "a=1,pt:1=[1 1],a=1,pt:1 2" {
+		t.Fatalf("unexpected items '%v'", before)
+	}
+
+	// the writer is not blocked by the open read-only transaction
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("b", "0", nil); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("pt:2", "[2 2]", nil); err != nil {
+			return err
+		}
+		_, err := tx.Delete("pt:1")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if items := dump(rtx); items != before {
+		t.Fatalf("expecting '%v', got '%v'", before, items)
+	}
+	if err := rtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	after := "a=1,b=0,pt:2=[2 2],b=0,a=1,pt:2 3"
+	if err := db.View(func(tx *Tx) error {
+		if items := dump(tx); items != after {
+			t.Fatalf("expecting '%v', got '%v'", after, items)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reader is not blocked by an open read/write transaction, and does
+	// not see its changes
+	wtx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := wtx.Set("c", "3", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if items := dump(tx); items != after {
+			t.Fatalf("expecting '%v', got '%v'", after, items)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the r-tree of the snapshot is reused when the index has not changed
+	db.snapmu.RLock()
+	pts := db.snap.idxs["pts"]
+	db.snapmu.RUnlock()
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("d", "4", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.snapmu.RLock()
+	defer db.snapmu.RUnlock()
+	if db.snap.idxs["pts"] != pts {
+		t.Fatal("expecting the same snapshot of the spatial index")
+	}
+}
+
+func TestTxContext(t *testing.T) {
+	db, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	if err := db.CreateSpatialIndex("pts", "*", IndexRect); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		if tx.Context() != context.Background() {
+			t.Fatal("expecting the background context")
+		}
+		for i := 0; i < 10; i++ {
+			_, _, err := tx.Set(fmt.Sprintf("key:%d", i), Point(float64(i), 0), nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the iterations stop when the context is canceled
+	scans := []func(tx *Tx, iter Iterator) error{
+		func(tx *Tx, iter Iterator) error { return tx.Ascend("", iter) },
+		func(tx *Tx, iter Iterator) error { return tx.DescendRange("", "z", "a", iter) },
+		func(tx *Tx, iter Iterator) error { return tx.AscendKeys("key:*", iter) },
+		func(tx *Tx, iter Iterator) error { return tx.Intersects("pts", "[0 0],[9 9]", iter) },
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	for i, scan := range scans {
+		ctx, cancel = context.WithCancel(context.Background())
+		var n int
+		err := db.ViewContext(ctx, func(tx *Tx) error {
+			if tx.Context() != ctx {
+				t.Fatal("expecting the context of the transaction")
+			}
+			return scan(tx, func(key, val string) bool {
+				n++
+				if n == 2 {
+					cancel()
+				}
+				return true
+			})
+		})
+		if err != context.Canceled || n != 2 {
+			t.Fatalf("scan %d: expecting '%v', got '%v' after %d items",
+				i, context.Canceled, err, n)
+		}
+	}
+	cancel()
+	called := false
+	err = db.ViewContext(ctx, func(tx *Tx) error {
+		called = true
+		return nil
+	})
+	if err != context.Canceled || called {
+		t.Fatalf("expecting '%v', got '%v'", context.Canceled, err)
+	}
+
+	// waiting for another read/write transaction stops at the deadline
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = db.UpdateContext(ctx, func(tx *Tx) error {
+		called = true
+		return nil
+	})
+	if err != context.DeadlineExceeded || called {
+		t.Fatalf("expecting '%v', got '%v'", context.DeadlineExceeded, err)
+	}
+	if _, _, err := tx.Set("key:0", "new", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// the lock that was acquired after the deadline is released
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := db.UpdateContext(ctx, func(tx *Tx) error {
+		_, err := tx.Delete("key:0")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSavepoints(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = db.Close() }()
+	if err := db.CreateIndex("vals", "*", IndexString); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("c", "3", nil); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("d", "4", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// dump returns the items in the order of the values.
+	dump := func(tx *Tx) string {
+		var items []string
+		if err := tx.Ascend("vals", func(key, val string) bool {
+			ttl, _ := tx.TTL(key)
+			items = append(items, fmt.Sprintf("%s=%s(%v)", key, val, ttl > 0))
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(items, ",")
+	}
+	errFailed := errors.New("failed")
+	if err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("a", "1", nil); err != nil {
+			return err
+		}
+		sp := tx.Savepoint()
+		if _, _, err := tx.Set("b", "2", nil); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("a", "5", nil); err != nil {
+			return err
+		}
+		if _, err := tx.Delete("c"); err != nil {
+			return err
+		}
+		if err := tx.Expire("d", time.Hour); err != nil {
+			return err
+		}
+		sp2 := tx.Savepoint()
+		if _, _, err := tx.Set("e", "0", nil); err != nil {
+			return err
+		}
+		if err := tx.RollbackTo(sp); err != nil {
+			return err
+		}
+		if items := dump(tx); items != "a=1(false),c=3(false),d=4(false)" {
+			t.Fatalf("unexpected items '%v'", items)
+		}
+		if err := tx.RollbackTo(sp2); err != ErrInvalidOperation {
+			t.Fatalf("expecting '%v', got '%v'", ErrInvalidOperation, err)
+		}
+		if err := tx.RollbackTo(Savepoint{}); err != ErrInvalidOperation {
+			t.Fatalf("expecting '%v', got '%v'", ErrInvalidOperation, err)
+		}
+		// the invalid savepoint stays invalid after more changes
+		sp3 := tx.Savepoint()
+		for _, key := range []string{"e", "f", "g", "h", "i"} {
+			if _, _, err := tx.Set(key, "0", nil); err != nil {
+				return err
+			}
+		}
+		if err := tx.RollbackTo(sp2); err != ErrInvalidOperation {
+			t.Fatalf("expecting '%v', got '%v'", ErrInvalidOperation, err)
+		}
+		if err := tx.RollbackTo(sp3); err != nil {
+			return err
+		}
+		if err := tx.RollbackTo(sp); err != nil {
+			return err
+		}
+		if err := tx.RollbackTo(sp3); err != ErrInvalidOperation {
+			t.Fatalf("expecting '%v', got '%v'", ErrInvalidOperation, err)
+		}
+		if items := dump(tx); items != "a=1(false),c=3(false),d=4(false)" {
+			t.Fatalf("unexpected items '%v'", items)
+		}
+
+		// a failed nested function only reverts its own changes
+		err := tx.Nested(func(tx *Tx) error {
+			if _, _, err := tx.Set("b", "6", nil); err != nil {
+				return err
+			}
+			err := tx.Nested(func(tx *Tx) error {
+				if _, err := tx.Delete("a"); err != nil {
+					return err
+				}
+				return errFailed
+			})
+			if err != errFailed {
+				t.Fatalf("expecting '%v', got '%v'", errFailed, err)
+			}
+			return tx.Nested(func(tx *Tx) error {
+				return tx.Expire("c", time.Hour)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		if err := tx.Nested(func(tx *Tx) error {
+			if _, _, err := tx.Set("f", "7", nil); err != nil {
+				return err
+			}
+			return errFailed
+		}); err != errFailed {
+			t.Fatalf("expecting '%v', got '%v'", errFailed, err)
+		}
+		changes, err := tx.Changes()
+		if err != nil {
+			return err
+		}
+		if len(changes) != 3 || changes[0].Key != "a" ||
+			changes[1].Key != "b" || changes[2].Key != "c" ||
+			changes[2].Type != ChangeTTL {
+			t.Fatalf("unexpected changes '%v'", changes)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expect := "a=1(false),c=3(true),d=4(false),b=6(false)"
+	check := func() {
+		t.Helper()
+		if err := db.View(func(tx *Tx) error {
+			if items := dump(tx); items != expect {
+				t.Fatalf("expecting '%v', got '%v'", expect, items)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check()
+	// the file only has the changes that were not rolled back
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("vals", "*", IndexString); err != nil && err != ErrIndexExists {
+		t.Fatal(err)
+	}
+	check()
+
+	// a rollback of the transaction reverts the nested changes too
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.Nested(func(tx *Tx) error {
+			_, err := tx.Delete("a")
+			return err
+		}); err != nil {
+			return err
+		}
+		return errFailed
+	}); err != errFailed {
+		t.Fatalf("expecting '%v', got '%v'", errFailed, err)
+	}
+	check()
+	if err := db.View(func(tx *Tx) error {
+		if err := tx.RollbackTo(tx.Savepoint()); err != ErrTxNotWritable {
+			t.Fatalf("expecting '%v', got '%v'", ErrTxNotWritable, err)
+		}
+		return tx.Nested(func(tx *Tx) error { return nil })
+	}); err != ErrTxNotWritable {
+		t.Fatalf("expecting '%v', got '%v'", ErrTxNotWritable, err)
+	}
+}
+
+func TestAscendKeys(t *testing.T) {
+	db, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	err = db.Update(func(tx *Tx) error {
+		for i, key := range []string{"user:1", "user:2", "user:10", "post:1"} {
+			if _, _, err := tx.Set(key, strconv.Itoa(40-i), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx *Tx) error {
+		var keys []string
+		err := tx.AscendKeys("user:?", func(key, val string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if strings.Join(keys, ",") != "user:1,user:2" {
+			t.Fatalf("expecting '%v', got '%v'", "user:1,user:2", keys)
+		}
+		// continue after a key
+		for _, test := range []struct {
+			pattern, pivot, expect string
+		}{
+			{"user:*", "user:1", "user:10,user:2"},
+			{"user:*", "a", "user:1,user:10,user:2"},
+			{"user:*", "user:2", ""},
+			{"*", "post:1", "user:1,user:10,user:2"},
+		} {
+			keys = nil
+			err := tx.AscendKeysGreaterThan(test.pattern, test.pivot,
+				func(key, val string) bool {
+					keys = append(keys, key)
+					return true
+				})
+			if err != nil {
+				return err
+			}
+			if strings.Join(keys, ",") != test.expect {
+				t.Fatalf("expecting '%v', got '%v'", test.expect, keys)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexPivots(t *testing.T) {
+	db, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	if err := db.CreateIndex("ages", "user:*", IndexInt); err != nil {
+		t.Fatal(err)
+	}
+	// the order of the keys is the reverse of the order of the values.
+	err = db.Update(func(tx *Tx) error {
+		for i, key := range []string{"user:1", "user:2", "user:3", "user:4"} {
+			if _, _, err := tx.Set(key, strconv.Itoa(40-i), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pivots of an index are compared with the values, not the keys.
+	err = db.View(func(tx *Tx) error {
+		for _, test := range []struct {
+			scan   func(iter Iterator) error
+			expect string
+		}{
+			{func(iter Iterator) error {
+				return tx.AscendGreaterOrEqual("ages", "39", iter)
+			}, "user:2,user:1"},
+			{func(iter Iterator) error {
+				return tx.AscendLessThan("ages", "39", iter)
+			}, "user:4,user:3"},
+			{func(iter Iterator) error {
+				return tx.AscendRange("ages", "38", "40", iter)
+			}, "user:3,user:2"},
+			{func(iter Iterator) error {
+				return tx.DescendLessOrEqual("ages", "39", iter)
+			}, "user:2,user:3,user:4"},
+			{func(iter Iterator) error {
+				return tx.DescendGreaterThan("ages", "38", iter)
+			}, "user:1,user:2"},
+			{func(iter Iterator) error {
+				return tx.DescendRange("ages", "39", "37", iter)
+			}, "user:2,user:3"},
+		} {
+			var keys []string
+			if err := test.scan(func(key, val string) bool {
+				keys = append(keys, key)
+				return true
+			}); err != nil {
+				return err
+			}
+			if strings.Join(keys, ",") != test.expect {
+				t.Fatalf("expecting '%v', got '%v'", test.expect, keys)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexDescendEqualValues(t *testing.T) {
+	db, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	if err := db.CreateIndex("ages", "*", IndexInt); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		for key, val := range map[string]string{
+			"a": "30", "b": "20", "c": "20", "d": "20", "e": "10",
+		} {
+			if _, _, err := tx.Set(key, val, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the items that are equal to a pivot are included or excluded as a
+	// whole, no matter how their keys compare to an empty key.
+	err = db.View(func(tx *Tx) error {
+		for _, test := range []struct {
+			scan   func(iter Iterator) error
+			expect string
+		}{
+			{func(iter Iterator) error {
+				return tx.DescendLessOrEqual("ages", "20", iter)
+			}, "d,c,b,e"},
+			{func(iter Iterator) error {
+				return tx.DescendGreaterThan("ages", "20", iter)
+			}, "a"},
+			{func(iter Iterator) error {
+				return tx.DescendRange("ages", "20", "10", iter)
+			}, "d,c,b"},
+			{func(iter Iterator) error {
+				return tx.AscendGreaterOrEqual("ages", "20", iter)
+			}, "b,c,d,a"},
+			{func(iter Iterator) error {
+				return tx.AscendLessThan("ages", "20", iter)
+			}, "e"},
+		} {
+			var keys []string
+			if err := test.scan(func(key, val string) bool {
+				keys = append(keys, key)
+				return true
+			}); err != nil {
+				return err
+			}
+			if strings.Join(keys, ",") != test.expect {
+				t.Fatalf("expecting '%v', got '%v'", test.expect, keys)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetLess(t *testing.T) {
+	db, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	if err := db.CreateIndex("names", "*", IndexString); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSpatialIndex("pts", "pt:*", IndexRect); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		less, err := tx.GetLess("names")
+		if err != nil {
+			return err
+		}
+		if !less("a", "B") || less("A", "a") || less("a", "A") {
+			t.Fatal("expecting a case-insensitive less function")
+		}
+		for _, index := range []string{"pts", "none"} {
+			if _, err := tx.GetLess(index); err != ErrNotFound {
+				t.Fatalf("expecting '%v', got '%v'", ErrNotFound, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	for i := 0; i < 3; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(fmt.Sprintf("key:%d", i), "val", nil)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Verify("data.db"); err != nil || n != int64(len(data)) {
+		t.Fatalf("expecting '%v', got '%v' (%v)", len(data), n, err)
+	}
+	// the offset of the last transaction
+	last := int64(bytes.LastIndex(data, []byte("*1\r\n$5\r\nmulti\r\n")))
+	if err := ioutil.WriteFile("data.db", data[:len(data)-5], 0666); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Verify("data.db"); err != io.ErrUnexpectedEOF || n != last {
+		t.Fatalf("expecting '%v', got '%v' (%v)", last, n, err)
+	}
+	corrupt := append([]byte{}, data...)
+	copy(corrupt[last+int64(len("*1\r\n$5\r\nmulti\r\n")):], "*1\r\n$3\r\nbad\r\n")
+	if err := ioutil.WriteFile("data.db", corrupt, 0666); err != nil {
+		t.Fatal(err)
+	}
+	// the offset is the record that could not be read
+	if n, err := Verify("data.db"); err != ErrInvalid || n <= last ||
+		n >= int64(len(data)) {
+		t.Fatalf("expecting an offset in the last transaction, got '%v' (%v)",
+			n, err)
+	}
+	if _, err := Verify("missing.db"); !os.IsNotExist(err) {
+		t.Fatalf("expecting '%v', got '%v'", "not exist", err)
+	}
+}
+
 func testUint64Hex(n uint64) string {
 	s := strconv.FormatUint(n, 16)
 	s = "0000000000000000" + s
@@ -0,0 +1,379 @@
+// Package cluster replicates a buntdb database to a cluster of nodes using the
+// Raft consensus algorithm.
+//
+// Each node has its own database. Update transactions run on the leader and
+// their changes are appended to the Raft log, which is replayed into the
+// database of every node once a majority of the nodes have the changes. The
+// log is compacted with snapshots that are created by DB.Save(), and a node
+// that has fallen behind the compacted log receives the snapshot.
+//
+// The nodes talk to each other over TCP. Each node keeps its Raft state, which
+// is the term, the vote, the log and the last snapshot, in the directory of
+// Config.Dir, and it's synced to disk before the other nodes are told about
+// it. The database of a node is kept in memory and is rebuilt from the
+// snapshot and the log when the node is restarted.
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+var (
+	// ErrNotLeader is returned when a transaction is started on a node that
+	// is not the leader. The leader is returned by Node.Leader().
+	ErrNotLeader = errors.New("not the leader")
+
+	// ErrLeadershipLost is returned when the node lost its leadership before
+	// a transaction was committed. The transaction may or may not have been
+	// committed by the new leader.
+	ErrLeadershipLost = errors.New("leadership lost")
+
+	// ErrTimeout is returned when the leader cannot reach a majority of the
+	// nodes in time.
+	ErrTimeout = errors.New("timeout")
+
+	// ErrClosed is returned when the node is closed.
+	ErrClosed = errors.New("node closed")
+
+	// ErrNoDir is returned when the configuration does not have a Dir.
+	ErrNoDir = errors.New("no directory")
+)
+
+// Config represents the configuration of a node.
+type Config struct {
+	// Dir is the directory where the node keeps its Raft state, which is
+	// created when it does not exist. A node that is restarted must use the
+	// same directory, otherwise it may undo the changes that the cluster
+	// has committed. Every node needs its own directory. It's required.
+	Dir string
+
+	// HeartbeatInterval is how often the leader sends heartbeats to the
+	// other nodes. The default is 50ms.
+	HeartbeatInterval time.Duration
+
+	// ElectionTimeout is how long a node waits for a heartbeat before it
+	// starts an election. The actual timeout is a random duration between
+	// ElectionTimeout and twice the ElectionTimeout. The default is 500ms.
+	ElectionTimeout time.Duration
+
+	// SnapshotThreshold is the number of applied log entries that trigger a
+	// snapshot, which removes those entries from the log. The default is
+	// 1024.
+	SnapshotThreshold int
+}
+
+// DefaultConfig returns the default configuration.
+func DefaultConfig() Config {
+	return Config{
+		HeartbeatInterval: 50 * time.Millisecond,
+		ElectionTimeout:   500 * time.Millisecond,
+		SnapshotThreshold: 1024,
+	}
+}
+
+// role is the role of a node in the current term.
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// entry is an entry of the log. The first entry of a new leader has no
+// changes.
+type entry struct {
+	Term    uint64
+	Changes []buntdb.Change
+}
+
+// Node is a member of a cluster.
+type Node struct {
+	id     string   // the address of the node
+	peers  []string // the addresses of the other nodes
+	config Config
+	ln     net.Listener
+	wg     sync.WaitGroup // the background goroutines
+
+	mu       sync.Mutex
+	cond     *sync.Cond // signaled when the state below changes
+	closed   bool
+	term     uint64
+	votedFor string
+	role     role
+	leader   string
+	log      []entry // log[0] is the last entry of the snapshot
+	base     uint64  // the index of log[0]
+	snapshot []byte  // the snapshot up to base
+	commit   uint64  // the index of the last committed entry
+	applied  uint64  // the index of the last applied entry
+	heard    time.Time
+	timeout  time.Duration
+	sent     time.Time            // when the last heartbeat was sent
+	ready    uint64               // the index of the first entry of the leader
+	next     map[string]uint64    // the next entry to send to a node
+	match    map[string]uint64    // the last entry that a node has
+	dirty    map[string]bool      // a node needs a new append request
+	inflight map[string]bool      // a node has a replication goroutine
+	round    uint64               // the heartbeat round of the leader
+	acked    map[string]uint64    // the last round a node acknowledged
+	contact  map[string]time.Time // the last response from a node
+	waiters  map[uint64]waiter    // the pending transactions, by log index
+	conns    map[net.Conn]bool    // the accepted connections
+	clients  map[string]*client
+
+	store  *storage
+	broken error // the storage failed, the node stops taking part
+
+	proposemu sync.Mutex // serializes Update transactions
+	dbmu      sync.RWMutex
+	db        *buntdb.DB
+}
+
+// waiter is a transaction that waits to be applied.
+type waiter struct {
+	term uint64
+	ch   chan error
+}
+
+// Open starts a node that listens on addr. The peers are the addresses of all
+// nodes in the cluster, and may include addr.
+func Open(addr string, peers []string, config Config) (*Node, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	n, err := Serve(ln, peers, config)
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// Serve starts a node that accepts connections from the other nodes on the
+// listener. The address of the node is the address of the listener. The node
+// continues from the Raft state in the directory of the configuration.
+func Serve(ln net.Listener, peers []string, config Config) (*Node, error) {
+	if config.Dir == "" {
+		return nil, ErrNoDir
+	}
+	def := DefaultConfig()
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = def.HeartbeatInterval
+	}
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = def.ElectionTimeout
+	}
+	if config.SnapshotThreshold <= 0 {
+		config.SnapshotThreshold = def.SnapshotThreshold
+	}
+	store, err := openStorage(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	st, snap, entries, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	db, err := buntdb.Open(":memory:")
+	if err == nil && len(snap.Data) > 0 {
+		if err = db.Load(bytes.NewReader(snap.Data)); err != nil {
+			_ = db.Close()
+		}
+	}
+	if err != nil {
+		_ = store.close()
+		return nil, err
+	}
+	n := &Node{
+		id:       ln.Addr().String(),
+		config:   config,
+		ln:       ln,
+		term:     st.Term,
+		votedFor: st.VotedFor,
+		log:      append([]entry{{Term: snap.Term}}, entries...),
+		base:     snap.Index,
+		snapshot: snap.Data,
+		// The entries after the snapshot are applied once the node
+		// learns that they are committed.
+		commit:   snap.Index,
+		applied:  snap.Index,
+		heard:    time.Now(),
+		next:     make(map[string]uint64),
+		match:    make(map[string]uint64),
+		dirty:    make(map[string]bool),
+		inflight: make(map[string]bool),
+		acked:    make(map[string]uint64),
+		contact:  make(map[string]time.Time),
+		waiters:  make(map[uint64]waiter),
+		conns:    make(map[net.Conn]bool),
+		clients:  make(map[string]*client),
+		store:    store,
+		db:       db,
+	}
+	n.cond = sync.NewCond(&n.mu)
+	for _, peer := range peers {
+		if peer != n.id {
+			n.peers = append(n.peers, peer)
+		}
+	}
+	n.resetTimeout()
+	n.wg.Add(3)
+	go n.acceptLoop()
+	go n.tickLoop()
+	go n.applyLoop()
+	return n, nil
+}
+
+// ID returns the address of the node.
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Leader returns the address of the leader, or an empty string when the
+// leader is not known.
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// IsLeader returns true if the node is the leader.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == leader
+}
+
+// Close stops the node and closes its database. The node may be started again
+// with the same directory.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return ErrClosed
+	}
+	n.closed = true
+	n.role = follower
+	n.failWaiters(ErrClosed)
+	_ = n.ln.Close()
+	for conn := range n.conns {
+		_ = conn.Close()
+	}
+	clients := make([]*client, 0, len(n.clients))
+	for _, c := range n.clients {
+		clients = append(clients, c)
+	}
+	n.cond.Broadcast()
+	n.mu.Unlock()
+	for _, c := range clients {
+		c.mu.Lock()
+		c.close()
+		c.mu.Unlock()
+	}
+	n.wg.Wait()
+	n.dbmu.Lock()
+	defer n.dbmu.Unlock()
+	err := n.db.Close()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if serr := n.store.close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// Update executes a function within a read/write transaction on the leader,
+// and commits the changes that it made to the cluster. The changes are
+// visible on the leader when this function returns. ErrNotLeader is returned
+// when the node is not the leader.
+//
+// The leader steps down when it cannot reach a majority of the nodes, and the
+// transactions that it has not committed return ErrLeadershipLost. Those
+// transactions may still be committed by the next leader.
+func (n *Node) Update(fn func(tx *buntdb.Tx) error) error {
+	n.proposemu.Lock()
+	defer n.proposemu.Unlock()
+	if _, err := n.readIndex(false); err != nil {
+		return err
+	}
+	var changes []buntdb.Change
+	n.dbmu.RLock()
+	err := n.db.Update(func(tx *buntdb.Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		var err error
+		if changes, err = tx.Changes(); err != nil {
+			return err
+		}
+		// The changes are applied from the log.
+		return errDiscard
+	})
+	n.dbmu.RUnlock()
+	if err != errDiscard {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	ch, err := n.propose(changes)
+	if err != nil {
+		return err
+	}
+	return <-ch
+}
+
+// errDiscard is used to roll back the transaction of an Update.
+var errDiscard = errors.New("discard")
+
+// View executes a function within a read-only transaction on the leader. The
+// read is linearizable, the function sees the changes of every Update that
+// returned before View was called. ErrNotLeader is returned when the node is
+// not the leader.
+func (n *Node) View(fn func(tx *buntdb.Tx) error) error {
+	if _, err := n.readIndex(true); err != nil {
+		return err
+	}
+	return n.StaleView(fn)
+}
+
+// StaleView executes a function within a read-only transaction on the
+// database of the node, which may be a follower. The database may not have
+// the most recent changes.
+func (n *Node) StaleView(fn func(tx *buntdb.Tx) error) error {
+	n.dbmu.RLock()
+	defer n.dbmu.RUnlock()
+	return n.db.View(fn)
+}
+
+// applyEntry applies the changes of an entry to the database. The changes are
+// applied with Tx.Apply(), which does not evict items, thus a committed entry
+// has the same result on every node.
+func applyEntry(db *buntdb.DB, e entry) error {
+	if len(e.Changes) == 0 {
+		return nil
+	}
+	return db.Update(func(tx *buntdb.Tx) error {
+		for _, c := range e.Changes {
+			if err := tx.Apply(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// resetTimeout picks a new random election timeout.
+func (n *Node) resetTimeout() {
+	n.timeout = n.config.ElectionTimeout +
+		time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+}
@@ -0,0 +1,372 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// testConfig returns a configuration with short timeouts and a new
+// directory.
+func testConfig(t *testing.T) Config {
+	config := DefaultConfig()
+	config.Dir = t.TempDir()
+	config.HeartbeatInterval = 10 * time.Millisecond
+	config.ElectionTimeout = 100 * time.Millisecond
+	return config
+}
+
+// listen returns listeners on loopback addresses.
+func listen(t *testing.T, count int) ([]net.Listener, []string) {
+	t.Helper()
+	var lns []net.Listener
+	var addrs []string
+	for i := 0; i < count; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lns = append(lns, ln)
+		addrs = append(addrs, ln.Addr().String())
+	}
+	return lns, addrs
+}
+
+// waitLeader waits for one of the nodes to become the leader.
+func waitLeader(t *testing.T, nodes []*Node) *Node {
+	t.Helper()
+	start := time.Now()
+	for time.Since(start) < 5*time.Second {
+		for _, n := range nodes {
+			if n.IsLeader() {
+				return n
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("no leader")
+	return nil
+}
+
+// waitValue waits for a key to have a value in the database of a node.
+func waitValue(t *testing.T, n *Node, key, val string) {
+	t.Helper()
+	start := time.Now()
+	for {
+		var cur string
+		err := n.StaleView(func(tx *buntdb.Tx) error {
+			var err error
+			cur, err = tx.Get(key)
+			return err
+		})
+		if err == nil && cur == val {
+			return
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%s: expecting '%v', got '%v' (%v)", n.ID(), val, cur, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// set sets a key on the node.
+func set(n *Node, key, val string) error {
+	return n.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(key, val, nil)
+		return err
+	})
+}
+
+func TestCluster(t *testing.T) {
+	lns, addrs := listen(t, 3)
+	var nodes []*Node
+	for _, ln := range lns {
+		n, err := Serve(ln, addrs, testConfig(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = n.Close() }()
+		nodes = append(nodes, n)
+	}
+	leader := waitLeader(t, nodes)
+	if err := leader.Update(func(tx *buntdb.Tx) error {
+		for i := 0; i < 10; i++ {
+			_, _, err := tx.Set(fmt.Sprintf("key:%d", i), fmt.Sprintf("%d", i), nil)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Delete("key:9")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the changes are visible when the update returns
+	var count int
+	if err := leader.View(func(tx *buntdb.Tx) error {
+		var err error
+		count, err = tx.Len()
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 9 {
+		t.Fatalf("expecting '%v', got '%v'", 9, count)
+	}
+	// a failed transaction is not replicated
+	if err := leader.Update(func(tx *buntdb.Tx) error {
+		if _, _, err := tx.Set("key:0", "bad", nil); err != nil {
+			return err
+		}
+		return buntdb.ErrNotFound
+	}); err != buntdb.ErrNotFound {
+		t.Fatalf("expecting '%v', got '%v'", buntdb.ErrNotFound, err)
+	}
+	if err := set(leader, "key:1", "new"); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		if n == leader {
+			continue
+		}
+		if err := set(n, "a", "b"); err != ErrNotLeader {
+			t.Fatalf("expecting '%v', got '%v'", ErrNotLeader, err)
+		}
+		if err := n.View(func(tx *buntdb.Tx) error { return nil }); err != ErrNotLeader {
+			t.Fatalf("expecting '%v', got '%v'", ErrNotLeader, err)
+		}
+		if n.Leader() != leader.ID() {
+			t.Fatalf("expecting '%v', got '%v'", leader.ID(), n.Leader())
+		}
+		waitValue(t, n, "key:0", "0")
+		waitValue(t, n, "key:1", "new")
+	}
+
+	// the leader fails
+	if err := leader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var rest []*Node
+	for _, n := range nodes {
+		if n != leader {
+			rest = append(rest, n)
+		}
+	}
+	leader = waitLeader(t, rest)
+	if err := leader.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get("key:1")
+		if err != nil {
+			return err
+		}
+		if val != "new" {
+			t.Fatalf("expecting '%v', got '%v'", "new", val)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := set(leader, "key:2", "after"); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range rest {
+		waitValue(t, n, "key:2", "after")
+	}
+
+	// the leader cannot reach a majority
+	for _, n := range rest {
+		if n != leader {
+			if err := n.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := set(leader, "key:3", "lost"); err != ErrLeadershipLost &&
+		err != ErrNotLeader && err != ErrTimeout {
+		t.Fatalf("expecting '%v', got '%v'", ErrLeadershipLost, err)
+	}
+	if err := leader.View(func(tx *buntdb.Tx) error { return nil }); err == nil {
+		t.Fatal("expecting an error")
+	}
+}
+
+func TestClusterSnapshot(t *testing.T) {
+	lns, addrs := listen(t, 3)
+	// the last node starts after the log is compacted
+	if err := lns[2].Close(); err != nil {
+		t.Fatal(err)
+	}
+	var configs []Config
+	for range lns {
+		config := testConfig(t)
+		config.SnapshotThreshold = 10
+		configs = append(configs, config)
+	}
+	var nodes []*Node
+	for i, ln := range lns[:2] {
+		n, err := Serve(ln, addrs, configs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = n.Close() }()
+		nodes = append(nodes, n)
+	}
+	leader := waitLeader(t, nodes)
+	if err := leader.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set("ttl", "x", &buntdb.SetOptions{Expires: true,
+			TTL: time.Hour})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := set(leader, fmt.Sprintf("key:%d", i), fmt.Sprintf("%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leader.mu.Lock()
+	base := leader.base
+	leader.mu.Unlock()
+	if base == 0 {
+		t.Fatal("expecting a compacted log")
+	}
+
+	n, err := Open(addrs[2], addrs, configs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = n.Close() }()
+	waitValue(t, n, "key:0", "0")
+	waitValue(t, n, "key:49", "49")
+	if err := n.StaleView(func(tx *buntdb.Tx) error {
+		ttl, err := tx.TTL("ttl")
+		if err != nil {
+			return err
+		}
+		if ttl <= 0 {
+			t.Fatalf("expecting a ttl, got '%v'", ttl)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the entries that follow the snapshot are appended
+	if err := set(leader, "key:50", "50"); err != nil {
+		t.Fatal(err)
+	}
+	waitValue(t, n, "key:50", "50")
+}
+
+func TestClusterRestart(t *testing.T) {
+	lns, addrs := listen(t, 3)
+	var configs []Config
+	var nodes []*Node
+	for _, ln := range lns {
+		config := testConfig(t)
+		config.SnapshotThreshold = 10
+		n, err := Serve(ln, addrs, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configs = append(configs, config)
+		nodes = append(nodes, n)
+	}
+	leader := waitLeader(t, nodes)
+	// the keys are in the snapshots and in the logs
+	for i := 0; i < 25; i++ {
+		if err := set(leader, fmt.Sprintf("key:%d", i), fmt.Sprintf("%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range nodes {
+		if err := n.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the whole cluster restarts
+	nodes = nil
+	for i, addr := range addrs {
+		n, err := Open(addr, addrs, configs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = n.Close() }()
+		nodes = append(nodes, n)
+	}
+	leader = waitLeader(t, nodes)
+	if err := leader.View(func(tx *buntdb.Tx) error {
+		count, err := tx.Len()
+		if err != nil {
+			return err
+		}
+		if count != 25 {
+			t.Fatalf("expecting '%v', got '%v'", 25, count)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		waitValue(t, n, "key:0", "0")
+		waitValue(t, n, "key:24", "24")
+	}
+}
+
+func TestClusterPersistentState(t *testing.T) {
+	lns, addrs := listen(t, 1)
+	// the other nodes do not exist, and the node does not start an election
+	peers := append(addrs, "127.0.0.1:1", "127.0.0.1:2")
+	config := testConfig(t)
+	config.ElectionTimeout = time.Hour
+	n, err := Serve(lns[0], peers, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := n.handle(&request{Append: &appendRequest{Term: 3, Leader: peers[1],
+		Entries: []entry{{Term: 3, Changes: []buntdb.Change{{Key: "a", Value: "1"}}}}}})
+	if !resp.Success {
+		t.Fatal("expecting the entry to be appended")
+	}
+	resp = n.handle(&request{Vote: &voteRequest{Term: 4, Candidate: peers[1],
+		LastIndex: 1, LastTerm: 3}})
+	if !resp.Success {
+		t.Fatal("expecting a vote")
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the node keeps its term, vote and log after a restart
+	n, err = Open(addrs[0], peers, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = n.Close() }()
+	resp = n.handle(&request{Vote: &voteRequest{Term: 4, Candidate: peers[2],
+		LastIndex: 1, LastTerm: 3}})
+	if resp.Success || resp.Term != 4 {
+		t.Fatalf("expecting no vote in term '%v', got '%v'", 4, resp.Term)
+	}
+	resp = n.handle(&request{Vote: &voteRequest{Term: 5, Candidate: peers[2]}})
+	if resp.Success {
+		t.Fatal("expecting no vote for a candidate with a stale log")
+	}
+	// the entry is applied once the node learns that it's committed
+	resp = n.handle(&request{Append: &appendRequest{Term: 5, Leader: peers[1],
+		PrevIndex: 1, PrevTerm: 3, Commit: 1}})
+	if !resp.Success {
+		t.Fatal("expecting a heartbeat")
+	}
+	waitValue(t, n, "a", "1")
+}
+
+func TestClusterNoDir(t *testing.T) {
+	lns, addrs := listen(t, 1)
+	defer func() { _ = lns[0].Close() }()
+	if _, err := Serve(lns[0], addrs, DefaultConfig()); err != ErrNoDir {
+		t.Fatalf("expecting '%v', got '%v'", ErrNoDir, err)
+	}
+}
@@ -0,0 +1,780 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// maxEntries is the maximum number of entries in an append request.
+const maxEntries = 256
+
+// request is a message from one node to another. Only one of the fields is
+// set.
+type request struct {
+	Vote     *voteRequest
+	Append   *appendRequest
+	Snapshot *snapshotRequest
+}
+
+// voteRequest is sent by a candidate to ask for a vote.
+type voteRequest struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+// appendRequest is sent by the leader to replicate the log, and as a
+// heartbeat when it has no entries.
+type appendRequest struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []entry
+	Commit    uint64
+}
+
+// snapshotRequest is sent by the leader to a node that needs entries that
+// were removed from the log.
+type snapshotRequest struct {
+	Term      uint64
+	Leader    string
+	Index     uint64
+	IndexTerm uint64
+	Data      []byte
+}
+
+// response is the reply to a request. Success is true when a vote was granted
+// or the entries were appended. Next is the index of the entry that the
+// leader should send next after a failed append.
+type response struct {
+	Term    uint64
+	Success bool
+	Next    uint64
+}
+
+// lastIndex returns the index of the last entry in the log.
+func (n *Node) lastIndex() uint64 {
+	return n.base + uint64(len(n.log)) - 1
+}
+
+// termAt returns the term of an entry, which must not be before the snapshot.
+func (n *Node) termAt(index uint64) uint64 {
+	return n.log[index-n.base].Term
+}
+
+// saveState writes the term and the vote to the storage. A failure breaks the
+// node, which then stops taking part in the cluster, because the other nodes
+// may have been told about the state.
+func (n *Node) saveState() {
+	if n.broken == nil {
+		n.broken = n.store.saveState(n.term, n.votedFor)
+	}
+}
+
+// saveEntries writes the entries of the log, from index to the last entry, to
+// the storage. A failure breaks the node.
+func (n *Node) saveEntries(index uint64) {
+	if n.broken == nil {
+		n.broken = n.store.appendEntries(index, n.log[index-n.base:])
+	}
+}
+
+// tickLoop starts elections and sends the heartbeats.
+func (n *Node) tickLoop() {
+	defer n.wg.Done()
+	t := time.NewTicker(n.config.HeartbeatInterval / 5)
+	defer t.Stop()
+	for range t.C {
+		n.mu.Lock()
+		if n.closed {
+			n.mu.Unlock()
+			return
+		}
+		if n.broken != nil {
+			if n.role != follower {
+				n.stepDown(n.term)
+			}
+		} else if n.role == leader {
+			if !n.hasQuorum() {
+				// The leader may have been replaced by a leader that
+				// can reach the other nodes.
+				n.stepDown(n.term)
+			} else if time.Since(n.sent) >= n.config.HeartbeatInterval {
+				n.broadcast()
+			}
+		} else if time.Since(n.heard) >= n.timeout {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// startElection makes the node a candidate in a new term.
+func (n *Node) startElection() {
+	n.term++
+	n.role = candidate
+	n.votedFor = n.id
+	n.leader = ""
+	n.heard = time.Now()
+	n.resetTimeout()
+	n.saveState()
+	if n.broken != nil {
+		return
+	}
+	term := n.term
+	req := &request{Vote: &voteRequest{
+		Term:      term,
+		Candidate: n.id,
+		LastIndex: n.lastIndex(),
+		LastTerm:  n.termAt(n.lastIndex()),
+	}}
+	votes := 1
+	if votes > (len(n.peers)+1)/2 {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.peers {
+		go func(peer string) {
+			resp, err := n.call(peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if n.role != candidate || n.term != term || !resp.Success {
+				return
+			}
+			votes++
+			if votes > (len(n.peers)+1)/2 {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader makes the candidate the leader. The leader appends an empty
+// entry, which commits the entries of the previous terms.
+func (n *Node) becomeLeader() {
+	n.log = append(n.log, entry{Term: n.term})
+	n.saveEntries(n.lastIndex())
+	if n.broken != nil {
+		n.stepDown(n.term)
+		return
+	}
+	n.role = leader
+	n.leader = n.id
+	n.ready = n.lastIndex()
+	for _, peer := range n.peers {
+		n.next[peer] = n.lastIndex()
+		n.match[peer] = 0
+		n.acked[peer] = 0
+		n.contact[peer] = time.Now()
+	}
+	n.advanceCommit()
+	n.broadcast()
+	n.cond.Broadcast()
+}
+
+// hasQuorum returns true if the leader received a response from a majority of
+// the nodes within the election timeout.
+func (n *Node) hasQuorum() bool {
+	count := 1
+	for _, peer := range n.peers {
+		if time.Since(n.contact[peer]) < n.config.ElectionTimeout {
+			count++
+		}
+	}
+	return count > (len(n.peers)+1)/2
+}
+
+// stepDown makes the node a follower, and moves to a newer term.
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.saveState()
+	}
+	if n.role == leader {
+		n.leader = ""
+		n.failWaiters(ErrLeadershipLost)
+	}
+	n.role = follower
+	n.cond.Broadcast()
+}
+
+// failWaiters stops the pending transactions with an error.
+func (n *Node) failWaiters(err error) {
+	for index, w := range n.waiters {
+		w.ch <- err
+		delete(n.waiters, index)
+	}
+}
+
+// propose appends the changes to the log of the leader. The returned channel
+// receives the result once the entry is applied.
+func (n *Node) propose(changes []buntdb.Change) (chan error, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, ErrClosed
+	}
+	if n.role != leader {
+		return nil, ErrNotLeader
+	}
+	n.log = append(n.log, entry{Term: n.term, Changes: changes})
+	n.saveEntries(n.lastIndex())
+	if n.broken != nil {
+		// The entry may have been written, which is the same as when
+		// the leader fails after the entry is appended.
+		n.log = n.log[:len(n.log)-1]
+		n.stepDown(n.term)
+		return nil, n.broken
+	}
+	ch := make(chan error, 1)
+	n.waiters[n.lastIndex()] = waiter{term: n.term, ch: ch}
+	n.advanceCommit()
+	n.broadcast()
+	return ch, nil
+}
+
+// broadcast sends the new entries, or a heartbeat, to every node.
+func (n *Node) broadcast() {
+	n.sent = time.Now()
+	n.round++
+	for _, peer := range n.peers {
+		n.dirty[peer] = true
+		if !n.inflight[peer] {
+			n.inflight[peer] = true
+			go n.replicate(peer)
+		}
+	}
+}
+
+// replicate sends requests to a node until it has all of the entries.
+func (n *Node) replicate(peer string) {
+	for {
+		n.mu.Lock()
+		if n.closed || n.role != leader || !n.dirty[peer] {
+			n.inflight[peer] = false
+			n.mu.Unlock()
+			return
+		}
+		n.dirty[peer] = false
+		term, round := n.term, n.round
+		var req request
+		var last uint64 // the last index that is sent
+		if next := n.next[peer]; next <= n.base {
+			req.Snapshot = &snapshotRequest{
+				Term:      term,
+				Leader:    n.id,
+				Index:     n.base,
+				IndexTerm: n.termAt(n.base),
+				Data:      n.snapshot,
+			}
+			last = n.base
+		} else {
+			entries := n.log[next-n.base:]
+			if len(entries) > maxEntries {
+				entries = entries[:maxEntries]
+			}
+			req.Append = &appendRequest{
+				Term:      term,
+				Leader:    n.id,
+				PrevIndex: next - 1,
+				PrevTerm:  n.termAt(next - 1),
+				Entries:   append([]entry(nil), entries...),
+				Commit:    n.commit,
+			}
+			last = next - 1 + uint64(len(entries))
+		}
+		n.mu.Unlock()
+
+		resp, err := n.call(peer, &req)
+
+		n.mu.Lock()
+		if err == nil {
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+			} else if n.role == leader && n.term == term {
+				n.contact[peer] = time.Now()
+				if resp.Success {
+					if last > n.match[peer] {
+						n.match[peer] = last
+						n.advanceCommit()
+					}
+					n.next[peer] = last + 1
+					if round > n.acked[peer] {
+						n.acked[peer] = round
+						n.cond.Broadcast()
+					}
+					if last < n.lastIndex() {
+						n.dirty[peer] = true
+					}
+				} else {
+					n.next[peer] = resp.Next
+					n.dirty[peer] = true
+				}
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+// advanceCommit commits the entries of the current term that a majority of
+// the nodes have.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commit; index-- {
+		if n.termAt(index) != n.term {
+			break
+		}
+		count := 1
+		for _, peer := range n.peers {
+			if n.match[peer] >= index {
+				count++
+			}
+		}
+		if count > (len(n.peers)+1)/2 {
+			n.commit = index
+			n.cond.Broadcast()
+			// Tell the other nodes about the commit.
+			for _, peer := range n.peers {
+				n.dirty[peer] = true
+			}
+			break
+		}
+	}
+}
+
+// readIndex waits until the leader has applied all of the committed entries,
+// and returns the index of the last one. When confirm is true, the leader
+// also confirms that it's still the leader, by a round of heartbeats that a
+// majority of the nodes acknowledge.
+func (n *Node) readIndex(confirm bool) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var timedOut bool
+	t := time.AfterFunc(n.config.ElectionTimeout, func() {
+		n.mu.Lock()
+		timedOut = true
+		n.cond.Broadcast()
+		n.mu.Unlock()
+	})
+	defer t.Stop()
+	// wait for the first entry of the leader to be committed
+	term := n.term
+	for {
+		if n.closed {
+			return 0, ErrClosed
+		}
+		if n.role != leader || n.term != term {
+			return 0, ErrNotLeader
+		}
+		if n.commit >= n.ready {
+			break
+		}
+		if timedOut {
+			return 0, ErrTimeout
+		}
+		n.cond.Wait()
+	}
+	index := n.commit
+	if confirm && len(n.peers) > 0 {
+		n.broadcast()
+		round := n.round
+		for {
+			if n.closed {
+				return 0, ErrClosed
+			}
+			if n.role != leader || n.term != term {
+				return 0, ErrNotLeader
+			}
+			count := 1
+			for _, peer := range n.peers {
+				if n.acked[peer] >= round {
+					count++
+				}
+			}
+			if count > (len(n.peers)+1)/2 {
+				break
+			}
+			if timedOut {
+				return 0, ErrTimeout
+			}
+			n.cond.Wait()
+		}
+	}
+	for n.applied < index {
+		if n.closed {
+			return 0, ErrClosed
+		}
+		n.cond.Wait()
+	}
+	return index, nil
+}
+
+// applyLoop applies the committed entries to the database.
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		for !n.closed && n.applied >= n.commit {
+			n.cond.Wait()
+		}
+		closed := n.closed
+		n.mu.Unlock()
+		if closed {
+			return
+		}
+
+		// The database lock keeps a snapshot from replacing the
+		// database while the entries are applied.
+		n.dbmu.RLock()
+		n.mu.Lock()
+		first := n.applied + 1
+		var entries []entry
+		if n.commit >= first {
+			entries = append(entries, n.log[first-n.base:n.commit-n.base+1]...)
+		}
+		n.mu.Unlock()
+		errs := make([]error, len(entries))
+		for i, e := range entries {
+			// Applying an entry only fails when the database is
+			// broken, the error is returned by the Update of the entry.
+			errs[i] = applyEntry(n.db, e)
+		}
+		n.mu.Lock()
+		n.applied = first - 1 + uint64(len(entries))
+		for i, e := range entries {
+			index := first + uint64(i)
+			if w, ok := n.waiters[index]; ok {
+				delete(n.waiters, index)
+				if w.term == e.Term {
+					w.ch <- errs[i]
+				} else {
+					w.ch <- ErrLeadershipLost
+				}
+			}
+		}
+		n.cond.Broadcast()
+		compact := n.applied-n.base >= uint64(n.config.SnapshotThreshold)
+		n.mu.Unlock()
+		if compact {
+			n.takeSnapshot()
+		}
+		n.dbmu.RUnlock()
+	}
+}
+
+// takeSnapshot saves the database and removes the applied entries from the
+// log. It's called while holding the read lock of the database.
+func (n *Node) takeSnapshot() {
+	var buf bytes.Buffer
+	if err := n.db.Save(&buf); err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.broken != nil {
+		return
+	}
+	index := n.applied
+	log := make([]entry, 0, n.lastIndex()-index+1)
+	log = append(log, entry{Term: n.termAt(index)})
+	log = append(log, n.log[index-n.base+1:]...)
+	snap := persistedSnapshot{Index: index, Term: log[0].Term, Data: buf.Bytes()}
+	if n.broken = n.store.saveSnapshot(snap, log[1:]); n.broken != nil {
+		return
+	}
+	n.log = log
+	n.base = index
+	n.snapshot = snap.Data
+}
+
+// handle handles a request from another node.
+// It returns nil when the storage of the node is broken, and the node then
+// does not reply, as if it had failed.
+func (n *Node) handle(req *request) *response {
+	resp := &response{}
+	switch {
+	case req.Vote != nil:
+		resp = n.handleVote(req.Vote)
+	case req.Append != nil:
+		resp = n.handleAppend(req.Append)
+	case req.Snapshot != nil:
+		resp = n.handleSnapshot(req.Snapshot)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.broken != nil {
+		return nil
+	}
+	return resp
+}
+
+func (n *Node) handleVote(req *voteRequest) *response {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+	resp := &response{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+	last := n.lastIndex()
+	upToDate := req.LastTerm > n.termAt(last) ||
+		(req.LastTerm == n.termAt(last) && req.LastIndex >= last)
+	if (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate {
+		n.votedFor = req.Candidate
+		n.heard = time.Now()
+		n.saveState()
+		resp.Success = true
+	}
+	return resp
+}
+
+func (n *Node) handleAppend(req *appendRequest) *response {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term || (req.Term == n.term && n.role != follower) {
+		n.stepDown(req.Term)
+	}
+	resp := &response{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+	n.leader = req.Leader
+	n.heard = time.Now()
+	prev, entries := req.PrevIndex, req.Entries
+	if prev < n.base {
+		// The entries before the snapshot are already committed.
+		skip := n.base - prev
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		prev, entries = prev+skip, entries[skip:]
+		if prev < n.base {
+			resp.Success = true
+			return resp
+		}
+	} else if prev > n.lastIndex() {
+		resp.Next = n.lastIndex() + 1
+		return resp
+	} else if n.termAt(prev) != req.PrevTerm {
+		// Skip all of the entries of the conflicting term.
+		next := prev
+		for next > n.base+1 && n.termAt(next-1) == n.termAt(prev) {
+			next--
+		}
+		resp.Next = next
+		return resp
+	}
+	for i, e := range entries {
+		index := prev + 1 + uint64(i)
+		if index <= n.lastIndex() {
+			if n.termAt(index) == e.Term {
+				continue
+			}
+			n.log = n.log[:index-n.base]
+		}
+		n.log = append(n.log, entries[i:]...)
+		n.saveEntries(index)
+		break
+	}
+	if req.Commit > n.commit {
+		n.commit = req.Commit
+		if last := prev + uint64(len(entries)); last < n.commit {
+			n.commit = last
+		}
+		n.cond.Broadcast()
+	}
+	resp.Success = true
+	return resp
+}
+
+func (n *Node) handleSnapshot(req *snapshotRequest) *response {
+	// The database lock stops the entries from being applied while the
+	// database is replaced.
+	n.dbmu.Lock()
+	defer n.dbmu.Unlock()
+	n.mu.Lock()
+	if req.Term > n.term || (req.Term == n.term && n.role != follower) {
+		n.stepDown(req.Term)
+	}
+	resp := &response{Term: n.term}
+	if req.Term < n.term || n.closed {
+		n.mu.Unlock()
+		return resp
+	}
+	n.leader = req.Leader
+	n.heard = time.Now()
+	resp.Success = true
+	if req.Index <= n.applied {
+		n.mu.Unlock()
+		return resp
+	}
+	n.mu.Unlock()
+
+	db, err := n.restore(req.Data)
+	if err != nil {
+		resp.Success = false
+		return resp
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.db = db
+	// Keep the entries that follow the snapshot.
+	log := []entry{{Term: req.IndexTerm}}
+	if req.Index < n.lastIndex() && n.termAt(req.Index) == req.IndexTerm {
+		log = append(log, n.log[req.Index-n.base+1:]...)
+	}
+	if n.broken == nil {
+		snap := persistedSnapshot{Index: req.Index, Term: req.IndexTerm,
+			Data: req.Data}
+		n.broken = n.store.saveSnapshot(snap, log[1:])
+	}
+	n.log = log
+	n.base = req.Index
+	n.snapshot = req.Data
+	if n.commit < req.Index {
+		n.commit = req.Index
+	}
+	n.applied = req.Index
+	n.heard = time.Now()
+	n.cond.Broadcast()
+	return resp
+}
+
+// restore replaces the database with a snapshot. The current database is
+// only closed once the snapshot is loaded into the new database. It's called
+// while holding the write lock of the database.
+func (n *Node) restore(data []byte) (*buntdb.DB, error) {
+	db, err := buntdb.Open(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Load(bytes.NewReader(data)); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	_ = n.db.Close()
+	return db, nil
+}
+
+// acceptLoop accepts the connections from the other nodes.
+func (n *Node) acceptLoop() {
+	defer n.wg.Done()
+	for {
+		conn, err := n.ln.Accept()
+		if err != nil {
+			return
+		}
+		n.mu.Lock()
+		if n.closed {
+			n.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		n.conns[conn] = true
+		n.mu.Unlock()
+		go n.serveConn(conn)
+	}
+}
+
+// serveConn handles the requests of a connection, one at a time.
+func (n *Node) serveConn(conn net.Conn) {
+	defer func() {
+		n.mu.Lock()
+		delete(n.conns, conn)
+		n.mu.Unlock()
+		_ = conn.Close()
+	}()
+	dec := gob.NewDecoder(conn)
+	enc := gob.NewEncoder(conn)
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		resp := n.handle(&req)
+		if resp == nil {
+			return
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// client is a connection to another node.
+type client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	enc  *gob.Encoder
+	dec  *gob.Decoder
+}
+
+// close closes the connection, which is dialed again by the next call. It's
+// called while holding the lock of the client.
+func (c *client) close() {
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// call sends a request to another node and waits for the response.
+func (n *Node) call(peer string, req *request) (*response, error) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, ErrClosed
+	}
+	c := n.clients[peer]
+	if c == nil {
+		c = &client{}
+		n.clients[peer] = c
+	}
+	n.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timeout := n.config.ElectionTimeout
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", peer, timeout)
+		if err != nil {
+			return nil, err
+		}
+		n.mu.Lock()
+		closed := n.closed
+		n.mu.Unlock()
+		if closed {
+			_ = conn.Close()
+			return nil, ErrClosed
+		}
+		c.conn = conn
+		c.enc = gob.NewEncoder(conn)
+		c.dec = gob.NewDecoder(conn)
+	}
+	_ = c.conn.SetDeadline(time.Now().Add(timeout))
+	if err := c.enc.Encode(req); err != nil {
+		c.close()
+		return nil, err
+	}
+	var resp response
+	if err := c.dec.Decode(&resp); err != nil {
+		c.close()
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,265 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// errCorruptLog is returned when the log file has a record that does not
+// follow the previous records.
+var errCorruptLog = errors.New("corrupt log")
+
+// storage keeps the Raft state of a node in a directory. The state file has
+// the term and the vote, the snapshot file has the last snapshot, and the log
+// file has the entries that follow the snapshot. The state and the snapshot
+// are replaced as a whole, while the entries are appended to the log. Every
+// change is synced to disk before it's used, thus a node that restarts has
+// the same state that the other nodes have seen.
+type storage struct {
+	dir string
+	log *os.File // the log file, opened for appending
+}
+
+// persistedState is the content of the state file.
+type persistedState struct {
+	Term     uint64
+	VotedFor string
+}
+
+// persistedSnapshot is the content of the snapshot file.
+type persistedSnapshot struct {
+	Index uint64 // the index of the last entry in the snapshot
+	Term  uint64 // the term of that entry
+	Data  []byte
+}
+
+// logRecord is a record of the log file. A record replaces the entry at its
+// index and removes the entries that follow it.
+type logRecord struct {
+	Index uint64
+	Entry entry
+}
+
+// openStorage opens the storage in a directory, which is created when it does
+// not exist.
+func openStorage(dir string) (*storage, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &storage{dir: dir}, nil
+}
+
+// load reads the state, the snapshot and the entries that follow the
+// snapshot. A record at the end of the log that was not fully written is
+// removed. The log file is then opened for appending.
+func (s *storage) load() (persistedState, persistedSnapshot, []entry, error) {
+	var st persistedState
+	var snap persistedSnapshot
+	if err := readFile(filepath.Join(s.dir, "state"), &st); err != nil {
+		return st, snap, nil, err
+	}
+	if err := readFile(filepath.Join(s.dir, "snapshot"), &snap); err != nil {
+		return st, snap, nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, "log"), os.O_CREATE|os.O_RDWR,
+		0666)
+	if err != nil {
+		return st, snap, nil, err
+	}
+	entries, n, err := readLog(f, snap.Index)
+	if err == nil {
+		// Remove a partial record.
+		err = f.Truncate(n)
+	}
+	if err == nil {
+		_, err = f.Seek(n, 0)
+	}
+	if err != nil {
+		_ = f.Close()
+		return st, snap, nil, err
+	}
+	s.log = f
+	return st, snap, entries, nil
+}
+
+// readLog reads the entries that follow the base index, and returns the
+// number of bytes of the complete records.
+func readLog(rd io.Reader, base uint64) ([]entry, int64, error) {
+	var entries []entry // entries[0] is at base+1
+	var n int64
+	var head [8]byte
+	for {
+		if _, err := io.ReadFull(rd, head[:]); err != nil {
+			return entries, n, nil
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(head[:4]))
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return entries, n, nil
+		}
+		if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(head[4:]) {
+			return entries, n, nil
+		}
+		var rec logRecord
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec); err != nil {
+			return nil, 0, err
+		}
+		n += int64(len(head) + len(data))
+		if rec.Index <= base {
+			// The entry is in the snapshot.
+			continue
+		}
+		i := rec.Index - base - 1
+		if i > uint64(len(entries)) {
+			return nil, 0, errCorruptLog
+		}
+		entries = append(entries[:i], rec.Entry)
+	}
+}
+
+// saveState replaces the term and the vote.
+func (s *storage) saveState(term uint64, votedFor string) error {
+	return writeFile(s.dir, "state", persistedState{term, votedFor})
+}
+
+// appendEntries writes the entries that begin at index, which replace the
+// entries at and after index.
+func (s *storage) appendEntries(index uint64, entries []entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := writeLog(&buf, index, entries); err != nil {
+		return err
+	}
+	if _, err := s.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// writeLog writes the records of the entries that begin at index.
+func writeLog(w io.Writer, index uint64, entries []entry) error {
+	var head [8]byte
+	for i, e := range entries {
+		var data bytes.Buffer
+		rec := logRecord{Index: index + uint64(i), Entry: e}
+		if err := gob.NewEncoder(&data).Encode(&rec); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(head[:4], uint32(data.Len()))
+		binary.LittleEndian.PutUint32(head[4:], crc32.ChecksumIEEE(data.Bytes()))
+		if _, err := w.Write(head[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(data.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveSnapshot replaces the snapshot, and replaces the log with the entries
+// that follow the snapshot. The log is replaced after the snapshot, thus the
+// entries that are in the snapshot are ignored when the node restarts in
+// between.
+func (s *storage) saveSnapshot(snap persistedSnapshot, entries []entry) error {
+	if err := writeFile(s.dir, "snapshot", snap); err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, "log")
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = writeLog(f, snap.Index+1, entries)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err == nil {
+		err = syncDir(s.dir)
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	_ = s.log.Close()
+	s.log = f
+	return nil
+}
+
+// close closes the log file.
+func (s *storage) close() error {
+	if s.log == nil {
+		return nil
+	}
+	return s.log.Close()
+}
+
+// readFile decodes a file that was written by writeFile. Nothing is decoded
+// when the file does not exist.
+func readFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// writeFile replaces a file in a directory with the encoded value. The value
+// is written to a new file that is synced and renamed, thus the file has
+// either the previous or the new value after a crash.
+func writeFile(dir, name string, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	return err
+}
+
+// syncDir syncs a directory, which makes a rename durable. Directories cannot
+// be synced on Windows.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package cluster
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tidwall/buntdb"
+)
+
+func TestStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.saveState(7, "node1"); err != nil {
+		t.Fatal(err)
+	}
+	var entries []entry
+	for i := 0; i < 5; i++ {
+		entries = append(entries, entry{Term: uint64(i + 1),
+			Changes: []buntdb.Change{{Key: "key", Value: string(rune('a' + i))}}})
+	}
+	if err := s.appendEntries(1, entries); err != nil {
+		t.Fatal(err)
+	}
+	// the entries at 4 and 5 are replaced by a single entry
+	if err := s.appendEntries(4, []entry{{Term: 9}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	// a record that was not fully written
+	f, err := os.OpenFile(filepath.Join(dir, "log"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{100, 0, 0, 0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(terms ...uint64) {
+		t.Helper()
+		s, err = openStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, _, entries, err := s.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Term != 7 || st.VotedFor != "node1" {
+			t.Fatalf("expecting '%v', got '%v'", persistedState{7, "node1"}, st)
+		}
+		if len(entries) != len(terms) {
+			t.Fatalf("expecting '%v', got '%v'", len(terms), len(entries))
+		}
+		for i, term := range terms {
+			if entries[i].Term != term {
+				t.Fatalf("expecting '%v', got '%v'", term, entries[i].Term)
+			}
+		}
+	}
+	check(1, 2, 3, 9)
+	// the log is appended after the partial record was removed
+	if err := s.appendEntries(5, []entry{{Term: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	check(1, 2, 3, 9, 10)
+
+	// the entries up to 2 are in the snapshot
+	snap := persistedSnapshot{Index: 2, Term: 2, Data: []byte("data")}
+	if err := s.saveSnapshot(snap, []entry{{Term: 3}, {Term: 9}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.appendEntries(5, []entry{{Term: 11}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	check(3, 9, 11)
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	_, snap, _, err = s.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Index != 2 || snap.Term != 2 || string(snap.Data) != "data" {
+		t.Fatalf("expecting '%v', got '%v'", 2, snap)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,61 @@
+// Command buntdb-server serves a buntdb database over the Redis protocol.
+//
+//	buntdb-server -addr :9851 -path data.db
+//
+// Any Redis client, such as redis-cli, can be used to talk to the server. See
+// the server package for the supported commands.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/buntdb/server"
+)
+
+func main() {
+	addr := flag.String("addr", ":9851", "the address to listen on")
+	path := flag.String("path", "data.db",
+		"the database file, or :memory: for no persistence")
+	sync := flag.String("sync", "everysecond",
+		"the sync policy: never, everysecond, or always")
+	flag.Parse()
+
+	config := buntdb.DefaultConfig()
+	switch *sync {
+	case "never":
+		config.SyncPolicy = buntdb.Never
+	case "everysecond":
+		config.SyncPolicy = buntdb.EverySecond
+	case "always":
+		config.SyncPolicy = buntdb.Always
+	default:
+		log.Fatalf("invalid sync policy: %s", *sync)
+	}
+	db, err := buntdb.OpenWithConfig(*path, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := server.New(db)
+
+	// Close the database cleanly on an interrupt.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		_ = s.Close()
+	}()
+
+	log.Printf("serving %s on %s", *path, *addr)
+	if err := s.ListenAndServe(*addr); err != server.ErrServerClosed {
+		_ = db.Close()
+		log.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
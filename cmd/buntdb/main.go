@@ -0,0 +1,439 @@
+// Command buntdb inspects and maintains buntdb database files.
+//
+//	buntdb -path data.db get user:1
+//	buntdb -path data.db keys 'user:*'
+//	buntdb -path data.db verify
+//	buntdb -path data.db
+//
+// Without a command an interactive prompt is started, which accepts the same
+// commands. Run "buntdb help" for the list of commands.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+func main() {
+	path := flag.String("path", "data.db", "the database file")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: buntdb [-path file] [command [args]]\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\ncommands:\n")
+		printHelp(os.Stderr)
+	}
+	flag.Parse()
+	c := &cli{path: *path, in: os.Stdin, out: os.Stdout}
+	var err error
+	if flag.NArg() == 0 {
+		err = c.repl(os.Stdin)
+	} else {
+		err = c.run(flag.Args())
+	}
+	if cerr := c.close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "buntdb: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// errUsage is returned when a command has the wrong number of arguments.
+var errUsage = errors.New("wrong number of arguments")
+
+// command is a command of the tool.
+type command struct {
+	args     string // the arguments, for the help
+	help     string // a short description
+	min, max int    // the number of arguments, max is -1 for no limit
+	writable bool   // opens the database for writing
+	nodb     bool   // does not open the database
+	fn       func(c *cli, args []string) error
+}
+
+// commands are the commands of the tool, by name.
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"get":     {"key", "print the value of a key", 1, 1, false, false, cmdGet},
+		"set":     {"key value [ttl]", "set a key, ttl is a duration such as 1h", 2, 3, true, false, cmdSet},
+		"del":     {"key [key ...]", "delete keys", 1, -1, true, false, cmdDel},
+		"keys":    {"[pattern]", "print the keys that match a pattern", 0, 1, false, false, cmdKeys},
+		"scan":    {"[index [start [stop]]]", "print the keys and values in order", 0, 3, false, false, cmdScan},
+		"stats":   {"", "print statistics about the database", 0, 0, false, false, cmdStats},
+		"shrink":  {"", "rewrite the file to its smallest size", 0, 0, true, false, cmdShrink},
+		"verify":  {"", "check the file and report the offset of corruption", 0, 0, false, true, cmdVerify},
+		"dump":    {"[file]", "write a snapshot to a file or stdout", 0, 1, false, false, cmdDump},
+		"restore": {"[file]", "load a snapshot from a file or stdin into an empty database", 0, 1, true, false, cmdRestore},
+		"help":    {"", "print this help", 0, 0, false, true, cmdHelp},
+	}
+}
+
+// printHelp prints the commands.
+func printHelp(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(w, "  %-30s %s\n", strings.TrimSpace(name+" "+cmd.args),
+			cmd.help)
+	}
+}
+
+// cli is the state of the tool. The database is opened by the first command
+// that needs it, and it's reopened for writing when a later command writes.
+type cli struct {
+	path     string
+	in       io.Reader // the input for restore, nil in the prompt
+	out      io.Writer
+	db       *buntdb.DB
+	writable bool // the database is opened for writing
+}
+
+// open opens the database, for writing if needed. The file must exist unless
+// create is true, thus a mistyped path is not created as an empty database.
+func (c *cli) open(writable, create bool) error {
+	if c.db != nil && (c.writable || !writable) {
+		return nil
+	}
+	if err := c.close(); err != nil {
+		return err
+	}
+	if !create {
+		if _, err := os.Stat(c.path); err != nil {
+			return err
+		}
+	}
+	// The tool cannot register the functions of the indexes, thus those
+	// indexes are skipped when the database is only read.
+	config := buntdb.DefaultConfig()
+	config.ReadOnly = !writable
+	config.SkipUnregisteredIndexes = true
+	var err error
+	c.db, err = buntdb.OpenWithConfig(c.path, config)
+	if errors.Is(err, buntdb.ErrFuncNotRegistered) {
+		return fmt.Errorf("%v, the database can only be read", err)
+	} else if err != nil {
+		return err
+	}
+	c.writable = writable
+	return nil
+}
+
+// close closes the database, if it's open.
+func (c *cli) close() error {
+	if c.db == nil {
+		return nil
+	}
+	err := c.db.Close()
+	c.db = nil
+	return err
+}
+
+// run runs a single command.
+func (c *cli) run(args []string) error {
+	name := strings.ToLower(args[0])
+	cmd := commands[name]
+	if cmd == nil {
+		return fmt.Errorf("unknown command '%s'", args[0])
+	}
+	args = args[1:]
+	if len(args) < cmd.min || (cmd.max != -1 && len(args) > cmd.max) {
+		return fmt.Errorf("%v, usage: %s", errUsage,
+			strings.TrimSpace(name+" "+cmd.args))
+	}
+	if !cmd.nodb {
+		if err := c.open(cmd.writable, name == "restore"); err != nil {
+			return err
+		}
+	}
+	return cmd.fn(c, args)
+}
+
+// repl reads commands from the reader until the end of the input, or until
+// the quit or exit command. Errors are printed and do not stop the prompt.
+func (c *cli) repl(rd io.Reader) error {
+	c.in = nil
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(nil, 64*1024*1024)
+	for {
+		fmt.Fprint(c.out, "buntdb> ")
+		if !sc.Scan() {
+			fmt.Fprintln(c.out)
+			return sc.Err()
+		}
+		args, err := splitArgs(sc.Text())
+		if err != nil {
+			fmt.Fprintf(c.out, "error: %v\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToLower(args[0]) {
+		case "quit", "exit":
+			return nil
+		}
+		if err := c.run(args); err != nil {
+			fmt.Fprintf(c.out, "error: %v\n", err)
+		}
+	}
+}
+
+// splitArgs splits a line into arguments that are separated by spaces. An
+// argument that contains spaces or special characters is written as a Go
+// quoted string.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return args, nil
+		}
+		if line[0] != '"' {
+			i := strings.IndexAny(line, " \t")
+			if i == -1 {
+				i = len(line)
+			}
+			args = append(args, line[:i])
+			line = line[i:]
+			continue
+		}
+		// Find the closing quote, skipping escaped characters.
+		end := -1
+		for i := 1; i < len(line); i++ {
+			if line[i] == '\\' {
+				i++
+			} else if line[i] == '"' {
+				end = i + 1
+				break
+			}
+		}
+		if end == -1 {
+			return nil, errors.New("unterminated quoted argument")
+		}
+		arg, err := strconv.Unquote(line[:end])
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted argument %s", line[:end])
+		}
+		args = append(args, arg)
+		line = line[end:]
+	}
+}
+
+// quote returns a string that is safe to print, which is the string itself
+// unless it contains spaces, quotes, or non-printable characters.
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\"") {
+		return strconv.Quote(s)
+	}
+	for _, r := range s {
+		if !strconv.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func cmdGet(c *cli, args []string) error {
+	return c.db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, quote(val))
+		return nil
+	})
+}
+
+func cmdSet(c *cli, args []string) error {
+	var opts *buntdb.SetOptions
+	if len(args) == 3 {
+		ttl, err := time.ParseDuration(args[2])
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid ttl '%s'", args[2])
+		}
+		opts = &buntdb.SetOptions{Expires: true, TTL: ttl}
+	}
+	return c.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(args[0], args[1], opts)
+		return err
+	})
+}
+
+func cmdDel(c *cli, args []string) error {
+	var n int
+	err := c.db.Update(func(tx *buntdb.Tx) error {
+		for _, key := range args {
+			if _, err := tx.Delete(key); err == nil {
+				n++
+			} else if err != buntdb.ErrNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "%d deleted\n", n)
+	return nil
+}
+
+func cmdKeys(c *cli, args []string) error {
+	pattern := "*"
+	if len(args) > 0 {
+		pattern = args[0]
+	}
+	return c.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(pattern, func(key, val string) bool {
+			fmt.Fprintln(c.out, quote(key))
+			return true
+		})
+	})
+}
+
+func cmdScan(c *cli, args []string) error {
+	var index string
+	if len(args) > 0 {
+		index = args[0]
+	}
+	iter := func(key, val string) bool {
+		fmt.Fprintf(c.out, "%s %s\n", quote(key), quote(val))
+		return true
+	}
+	return c.db.View(func(tx *buntdb.Tx) error {
+		switch len(args) {
+		case 3:
+			return tx.AscendRange(index, args[1], args[2], iter)
+		case 2:
+			return tx.AscendGreaterOrEqual(index, args[1], iter)
+		default:
+			return tx.Ascend(index, iter)
+		}
+	})
+}
+
+func cmdStats(c *cli, args []string) error {
+	var n, expires int
+	err := c.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		if n, err = tx.Len(); err != nil {
+			return err
+		}
+		return tx.Ascend("", func(key, val string) bool {
+			if ttl, err := tx.TTL(key); err == nil && ttl >= 0 {
+				expires++
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return err
+	}
+	indexes, err := c.db.Indexes()
+	if err != nil {
+		return err
+	}
+	sort.Strings(indexes)
+	mem, err := c.db.MemoryUsage()
+	if err != nil {
+		return err
+	}
+	seq, err := c.db.Seq()
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "keys:      %d\n", n)
+	fmt.Fprintf(c.out, "expires:   %d\n", expires)
+	fmt.Fprintf(c.out, "indexes:   %s\n", strings.Join(indexes, " "))
+	fmt.Fprintf(c.out, "memory:    %d\n", mem)
+	fmt.Fprintf(c.out, "file size: %d\n", fi.Size())
+	fmt.Fprintf(c.out, "sequence:  %d\n", seq)
+	return nil
+}
+
+func cmdShrink(c *cli, args []string) error {
+	before, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	if err := c.db.Shrink(); err != nil {
+		return err
+	}
+	after, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "shrunk from %d to %d bytes\n", before.Size(),
+		after.Size())
+	return nil
+}
+
+func cmdVerify(c *cli, args []string) error {
+	n, err := buntdb.Verify(c.path)
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("incomplete transaction at offset %d", n)
+	} else if err != nil {
+		if os.IsNotExist(err) {
+			return err
+		}
+		return fmt.Errorf("corrupted at offset %d: %v", n, err)
+	}
+	fmt.Fprintf(c.out, "ok, %d bytes\n", n)
+	return nil
+}
+
+func cmdDump(c *cli, args []string) error {
+	if len(args) == 0 {
+		return c.db.Save(c.out)
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if err := c.db.Save(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func cmdRestore(c *cli, args []string) error {
+	if len(args) == 0 {
+		if c.in == nil {
+			return errors.New("a file is required")
+		}
+		return c.db.Load(c.in)
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return c.db.Load(f)
+}
+
+func cmdHelp(c *cli, args []string) error {
+	printHelp(c.out)
+	return nil
+}
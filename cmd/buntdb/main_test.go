@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testRun runs a command and returns the output.
+func testRun(t *testing.T, c *cli, args ...string) string {
+	var out bytes.Buffer
+	c.out = &out
+	if err := c.run(args); err != nil {
+		t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	return out.String()
+}
+
+func TestCommands(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = os.RemoveAll("dump.db") }()
+	c := &cli{path: "data.db"}
+	defer func() { _ = c.close() }()
+
+	// only restore creates a missing file
+	if err := c.run([]string{"set", "user:1", "tom"}); !os.IsNotExist(err) {
+		t.Fatalf("expecting '%v', got '%v'", os.ErrNotExist, err)
+	}
+	if _, err := os.Stat("data.db"); !os.IsNotExist(err) {
+		t.Fatalf("expecting '%v', got '%v'", os.ErrNotExist, err)
+	}
+	c.in = strings.NewReader("")
+	testRun(t, c, "restore")
+	c.in = nil
+
+	testRun(t, c, "set", "user:1", "tom")
+	testRun(t, c, "set", "user:2", "jane doe", "1h")
+	testRun(t, c, "set", "item:1", "box")
+	if out := testRun(t, c, "get", "user:2"); out != "\"jane doe\"\n" {
+		t.Fatalf("expecting '%v', got '%v'", "\"jane doe\"\n", out)
+	}
+	if out := testRun(t, c, "keys", "user:*"); out != "user:1\nuser:2\n" {
+		t.Fatalf("expecting '%v', got '%v'", "user:1\nuser:2\n", out)
+	}
+	if out := testRun(t, c, "scan", "", "a", "j"); out != "item:1 box\n" {
+		t.Fatalf("expecting '%v', got '%v'", "item:1 box\n", out)
+	}
+	if out := testRun(t, c, "del", "item:1", "item:2"); out != "1 deleted\n" {
+		t.Fatalf("expecting '%v', got '%v'", "1 deleted\n", out)
+	}
+	out := testRun(t, c, "stats")
+	if !strings.Contains(out, "keys:      2\n") ||
+		!strings.Contains(out, "expires:   1\n") {
+		t.Fatalf("unexpected stats '%v'", out)
+	}
+	if out := testRun(t, c, "shrink"); !strings.HasPrefix(out, "shrunk") {
+		t.Fatalf("expecting '%v', got '%v'", "shrunk", out)
+	}
+	if out := testRun(t, c, "verify"); !strings.HasPrefix(out, "ok") {
+		t.Fatalf("expecting '%v', got '%v'", "ok", out)
+	}
+	testRun(t, c, "dump", "dump.db")
+	if err := c.run([]string{"restore", "dump.db"}); err == nil {
+		t.Fatal("expecting an error for a database that is not empty")
+	}
+	if err := c.run([]string{"get"}); err == nil ||
+		!strings.Contains(err.Error(), errUsage.Error()) {
+		t.Fatalf("expecting '%v', got '%v'", errUsage, err)
+	}
+	if err := c.run([]string{"rename"}); err == nil {
+		t.Fatal("expecting an error for an unknown command")
+	}
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restore the dump into an empty database
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	testRun(t, c, "restore", "dump.db")
+	if out := testRun(t, c, "keys"); out != "user:1\nuser:2\n" {
+		t.Fatalf("expecting '%v', got '%v'", "user:1\nuser:2\n", out)
+	}
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an index with a function that the tool does not have
+	f, err := os.OpenFile("data.db", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := "*4\r\n"
+	for _, arg := range []string{"createindex", "other", "*", "custom"} {
+		record += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := f.WriteString(record); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out := testRun(t, c, "verify"); !strings.HasPrefix(out, "ok") {
+		t.Fatalf("expecting '%v', got '%v'", "ok", out)
+	}
+	if out := testRun(t, c, "keys"); out != "user:1\nuser:2\n" {
+		t.Fatalf("expecting '%v', got '%v'", "user:1\nuser:2\n", out)
+	}
+	if err := c.run([]string{"set", "user:3", "x"}); err == nil ||
+		!strings.Contains(err.Error(), "custom") {
+		t.Fatalf("expecting '%v', got '%v'", "custom", err)
+	}
+	if err := c.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a corrupted file
+	data, err := ioutil.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, "*1\r\n$3\r\nbad\r\n"...)
+	if err := ioutil.WriteFile("data.db", data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	err = c.run([]string{"verify"})
+	if err == nil || !strings.Contains(err.Error(), "offset") {
+		t.Fatalf("expecting '%v', got '%v'", "offset", err)
+	}
+}
+
+func TestREPL(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	if err := ioutil.WriteFile("data.db", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	c := &cli{path: "data.db", out: &out}
+	defer func() { _ = c.close() }()
+	in := strings.Join([]string{
+		`set "hello world" "a\tb"`,
+		`keys`,
+		`get "hello world"`,
+		`get missing`,
+		`get "unterminated`,
+		``,
+		`exit`,
+		`get never`,
+	}, "\n")
+	if err := c.repl(strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"buntdb> buntdb> \"hello world\"",
+		"buntdb> \"a\\tb\"",
+		"buntdb> error: not found",
+		"buntdb> error: unterminated quoted argument",
+		"buntdb> buntdb> ",
+	}
+	if lines := strings.Split(out.String(), "\n"); !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("expecting '%q', got '%q'", expect, lines)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+	}{
+		{"", nil},
+		{"get key", []string{"get", "key"}},
+		{"  set\tkey  val ", []string{"set", "key", "val"}},
+		{`set "a \"b\"" ""`, []string{"set", `a "b"`, ""}},
+		{`set k "\x00"`, []string{"set", "k", "\x00"}},
+	}
+	for _, test := range tests {
+		args, err := splitArgs(test.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Fatalf("expecting '%q', got '%q'", test.args, args)
+		}
+	}
+	if _, err := splitArgs(`get "key`); err == nil {
+		t.Fatal("expecting an error")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package buntdb
+
+import "os"
+
+// lockFile does nothing because file locking is not supported on this
+// platform. Nothing stops two processes from opening the same database file
+// for writing, which corrupts the file, thus the application must make sure
+// that only one process opens the file.
+func lockFile(f *os.File, shared bool) error {
+	return nil
+}
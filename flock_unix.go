@@ -0,0 +1,27 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package buntdb
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an advisory lock on the file without blocking. A shared lock
+// allows for other shared locks, while an exclusive lock does not allow for
+// any other locks. ErrDatabaseLocked is returned when the file is already
+// locked by another process. The lock is released when the file is closed.
+func lockFile(f *os.File, shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return ErrDatabaseLocked
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package buntdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestFileLock(t *testing.T) {
+	if err := os.RemoveAll("data.db"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("data.db") }()
+	defer func() { _ = db.Close() }()
+	if _, err := Open("data.db"); err != ErrDatabaseLocked {
+		t.Fatalf("expecting '%v', got '%v'", ErrDatabaseLocked, err)
+	}
+	if _, err := Recover("data.db"); err != ErrDatabaseLocked {
+		t.Fatalf("expecting '%v', got '%v'", ErrDatabaseLocked, err)
+	}
+	// a read-only database does not lock by default.
+	rdb, err := OpenReadOnly("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.ReadOnly = true
+	config.SharedLock = true
+	if _, err := OpenWithConfig("data.db", config); err != ErrDatabaseLocked {
+		t.Fatalf("expecting '%v', got '%v'", ErrDatabaseLocked, err)
+	}
+	// the lock must be held across a shrink.
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("hello", "world", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open("data.db"); err != ErrDatabaseLocked {
+		t.Fatalf("expecting '%v', got '%v'", ErrDatabaseLocked, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// multiple shared locks are allowed, but not with a writer.
+	rdb1, err := OpenWithConfig("data.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rdb1.Close() }()
+	rdb2, err := OpenWithConfig("data.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rdb2.Close() }()
+	if _, err := Open("data.db"); err != ErrDatabaseLocked {
+		t.Fatalf("expecting '%v', got '%v'", ErrDatabaseLocked, err)
+	}
+	if err := rdb1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,43 @@
+//go:build windows
+// +build windows
+
+package buntdb
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+
+	errLockViolation syscall.Errno = 33 // ERROR_LOCK_VIOLATION
+)
+
+// lockFile takes a lock on the file without blocking. A shared lock allows for
+// other shared locks, while an exclusive lock does not allow for any other
+// locks. ErrDatabaseLocked is returned when the file is already locked by
+// another process. The lock is released when the file is closed.
+//
+// Windows locks are mandatory, thus the lock is taken on the last byte of the
+// largest possible file, which is never read, instead of on the contents.
+func lockFile(f *os.File, shared bool) error {
+	flags := uint32(lockfileFailImmediately)
+	if !shared {
+		flags |= lockfileExclusiveLock
+	}
+	ol := &syscall.Overlapped{Offset: ^uint32(0), OffsetHigh: ^uint32(0)}
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, 1, 0,
+		uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		if err == errLockViolation {
+			return ErrDatabaseLocked
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,576 @@
+// Package http provides an http.Handler that exposes a buntdb database as a
+// JSON API, for clients that cannot use the Redis protocol of the server
+// package.
+//
+// The endpoints are:
+//
+//	GET    /keys/{key}   get an item
+//	PUT    /keys/{key}   set an item, the body is a SetRequest
+//	DELETE /keys/{key}   delete an item
+//	GET    /ttl/{key}    get the remaining time-to-live of an item
+//	GET    /indexes      list the indexes
+//	GET    /scan         scan the keys or an index, see ServeHTTP
+//	GET    /intersects   search a spatial index, see ServeHTTP
+//	POST   /batch        run a list of operations in a single transaction
+//
+// Errors are returned as an Error object with a non-2xx status code.
+package http
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	nethttp "net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// Limits for the number of items returned by a scan.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 10000
+)
+
+// Handler serves the JSON API for a database.
+type Handler struct {
+	db  *buntdb.DB
+	mux *nethttp.ServeMux
+}
+
+// New returns a handler for the database. Use http.StripPrefix to serve the
+// API under a path other than the root.
+func New(db *buntdb.DB) *Handler {
+	h := &Handler{db: db, mux: nethttp.NewServeMux()}
+	h.mux.HandleFunc("/keys/", h.serveKey)
+	h.mux.HandleFunc("/ttl/", h.serveTTL)
+	h.mux.HandleFunc("/indexes", h.serveIndexes)
+	h.mux.HandleFunc("/scan", h.serveScan)
+	h.mux.HandleFunc("/intersects", h.serveIntersects)
+	h.mux.HandleFunc("/batch", h.serveBatch)
+	return h
+}
+
+// ServeHTTP implements http.Handler.
+//
+// The /scan endpoint accepts the query parameters index (empty for the keys),
+// desc, limit, cursor, and either gte and lt for ascending scans, or lte and gt
+// for descending scans. The response has a cursor that is empty when there
+// are no more items, otherwise it's passed as the cursor parameter of the next
+// request to continue the scan.
+//
+// The /intersects endpoint accepts the query parameters index, bounds, and
+// limit.
+func (h *Handler) ServeHTTP(w nethttp.ResponseWriter, r *nethttp.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Error is the response for a failed request.
+type Error struct {
+	Error string `json:"error"`
+	// Op is the index of the failed operation of a batch.
+	Op *int `json:"op,omitempty"`
+}
+
+// Item is a key-value item. TTL is the remaining time-to-live in seconds, and
+// is omitted for items that do not expire.
+type Item struct {
+	Key   string   `json:"key"`
+	Value string   `json:"value"`
+	TTL   *float64 `json:"ttl,omitempty"`
+}
+
+// SetRequest is the body of a PUT to /keys/{key}. TTL is the time-to-live in
+// seconds, zero means that the item does not expire. NX and XX are the same as
+// the fields of buntdb.SetOptions.
+type SetRequest struct {
+	Value string  `json:"value"`
+	TTL   float64 `json:"ttl,omitempty"`
+	NX    bool    `json:"nx,omitempty"`
+	XX    bool    `json:"xx,omitempty"`
+}
+
+// SetResponse is the response of a PUT to /keys/{key}.
+type SetResponse struct {
+	Previous string `json:"previous,omitempty"`
+	Replaced bool   `json:"replaced"`
+}
+
+// TTLResponse is the response of /ttl/{key}. TTL is the remaining
+// time-to-live in seconds, or -1 for an item that does not expire.
+type TTLResponse struct {
+	TTL float64 `json:"ttl"`
+}
+
+// IndexesResponse is the response of /indexes.
+type IndexesResponse struct {
+	Indexes []string `json:"indexes"`
+}
+
+// ScanResponse is the response of /scan and /intersects.
+type ScanResponse struct {
+	Items  []Item `json:"items"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// Op is an operation of a batch. Op is one of "get", "set", "del", "incr",
+// "expire", or "persist". The Value, TTL, NX, and XX fields are used by
+// "set", the Delta field by "incr", and the TTL field by "expire".
+type Op struct {
+	Op    string  `json:"op"`
+	Key   string  `json:"key"`
+	Value string  `json:"value,omitempty"`
+	TTL   float64 `json:"ttl,omitempty"`
+	NX    bool    `json:"nx,omitempty"`
+	XX    bool    `json:"xx,omitempty"`
+	Delta int64   `json:"delta,omitempty"`
+}
+
+// BatchRequest is the body of a POST to /batch.
+type BatchRequest struct {
+	Ops []Op `json:"ops"`
+}
+
+// Result is the result of an operation of a batch. Value is the value of a
+// "get", the previous value of a "set" or "del", or the new value of an
+// "incr".
+type Result struct {
+	Value string `json:"value,omitempty"`
+	Found bool   `json:"found"`
+}
+
+// BatchResponse is the response of a POST to /batch.
+type BatchResponse struct {
+	Results []Result `json:"results"`
+}
+
+// writeJSON writes v as the response with the status code.
+func writeJSON(w nethttp.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// statusCode returns the status code of the response for an error.
+func statusCode(err error) int {
+	if errors.Is(err, buntdb.ErrNotNumber) {
+		return nethttp.StatusBadRequest
+	}
+	switch err {
+	case buntdb.ErrNotFound:
+		return nethttp.StatusNotFound
+	case buntdb.ErrConditionFailed:
+		return nethttp.StatusPreconditionFailed
+	case buntdb.ErrOutOfMemory:
+		return nethttp.StatusInsufficientStorage
+	case buntdb.ErrTxNotWritable:
+		return nethttp.StatusForbidden
+	case buntdb.ErrInvalidOperation:
+		return nethttp.StatusBadRequest
+	}
+	if _, ok := err.(badRequest); ok {
+		return nethttp.StatusBadRequest
+	}
+	return nethttp.StatusInternalServerError
+}
+
+// writeError writes the error response that matches err.
+func writeError(w nethttp.ResponseWriter, err error) {
+	writeJSON(w, statusCode(err), Error{Error: err.Error()})
+}
+
+// badRequest is an error for an invalid request.
+type badRequest string
+
+func (e badRequest) Error() string { return string(e) }
+
+// writeBadRequest writes a bad request response with the message.
+func writeBadRequest(w nethttp.ResponseWriter, msg string) {
+	writeJSON(w, nethttp.StatusBadRequest, Error{Error: msg})
+}
+
+// methodAllowed writes a response and returns false when the method of the
+// request is not one of the methods.
+func methodAllowed(w nethttp.ResponseWriter, r *nethttp.Request,
+	methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, nethttp.StatusMethodNotAllowed,
+		Error{Error: "method not allowed"})
+	return false
+}
+
+// seconds converts a duration to seconds.
+func seconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Second)
+}
+
+// duration converts seconds to a duration.
+func duration(secs float64) time.Duration {
+	return time.Duration(secs * float64(time.Second))
+}
+
+// ttlOf returns the time-to-live of an item for an Item, or nil when the item
+// does not expire.
+func ttlOf(tx *buntdb.Tx, key string) *float64 {
+	ttl, err := tx.TTL(key)
+	if err != nil || ttl < 0 {
+		return nil
+	}
+	secs := seconds(ttl)
+	return &secs
+}
+
+func (h *Handler) serveKey(w nethttp.ResponseWriter, r *nethttp.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/keys/")
+	if key == "" {
+		writeBadRequest(w, "missing key")
+		return
+	}
+	switch r.Method {
+	case nethttp.MethodGet:
+		var item Item
+		err := h.db.View(func(tx *buntdb.Tx) error {
+			val, err := tx.Get(key)
+			if err != nil {
+				return err
+			}
+			item = Item{Key: key, Value: val, TTL: ttlOf(tx, key)}
+			return nil
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, nethttp.StatusOK, item)
+	case nethttp.MethodPut:
+		var req SetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeBadRequest(w, err.Error())
+			return
+		}
+		var res SetResponse
+		err := h.db.Update(func(tx *buntdb.Tx) error {
+			var err error
+			res.Previous, res.Replaced, err = tx.Set(key, req.Value,
+				setOptions(req.TTL, req.NX, req.XX))
+			return err
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, nethttp.StatusOK, res)
+	case nethttp.MethodDelete:
+		var item Item
+		err := h.db.Update(func(tx *buntdb.Tx) error {
+			val, err := tx.Delete(key)
+			item = Item{Key: key, Value: val}
+			return err
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, nethttp.StatusOK, item)
+	default:
+		methodAllowed(w, r, nethttp.MethodGet, nethttp.MethodPut,
+			nethttp.MethodDelete)
+	}
+}
+
+// setOptions returns the options for a set.
+func setOptions(ttl float64, nx, xx bool) *buntdb.SetOptions {
+	return &buntdb.SetOptions{
+		Expires: ttl > 0,
+		TTL:     duration(ttl),
+		NX:      nx,
+		XX:      xx,
+	}
+}
+
+func (h *Handler) serveTTL(w nethttp.ResponseWriter, r *nethttp.Request) {
+	if !methodAllowed(w, r, nethttp.MethodGet) {
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/ttl/")
+	var res TTLResponse
+	err := h.db.View(func(tx *buntdb.Tx) error {
+		ttl, err := tx.TTL(key)
+		if err != nil {
+			return err
+		}
+		res.TTL = -1
+		if ttl >= 0 {
+			res.TTL = seconds(ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, nethttp.StatusOK, res)
+}
+
+func (h *Handler) serveIndexes(w nethttp.ResponseWriter, r *nethttp.Request) {
+	if !methodAllowed(w, r, nethttp.MethodGet) {
+		return
+	}
+	names, err := h.db.Indexes()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	sort.Strings(names)
+	writeJSON(w, nethttp.StatusOK, IndexesResponse{Indexes: names})
+}
+
+// parseLimit returns the limit query parameter.
+func parseLimit(r *nethttp.Request) (int, bool) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return DefaultLimit, true
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 || n > MaxLimit {
+		return 0, false
+	}
+	return n, true
+}
+
+// cursor is the position of a scan, which is the value and key of the last
+// item that was returned.
+type cursor struct {
+	Value string `json:"v"`
+	Key   string `json:"k"`
+}
+
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// passed returns true if the item comes before or is the item of the cursor,
+// in the order of a scan. The items are ordered by the less function of the
+// index and then by the key, or only by the key when less is nil.
+func (c *cursor) passed(less func(a, b string) bool, desc bool,
+	key, val string) bool {
+	cmp := strings.Compare(key, c.Key)
+	if less != nil {
+		if less(val, c.Value) {
+			cmp = -1
+		} else if less(c.Value, val) {
+			cmp = 1
+		}
+	}
+	if desc {
+		return cmp >= 0
+	}
+	return cmp <= 0
+}
+
+func decodeCursor(s string) (*cursor, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, false
+	}
+	return &c, true
+}
+
+func (h *Handler) serveScan(w nethttp.ResponseWriter, r *nethttp.Request) {
+	if !methodAllowed(w, r, nethttp.MethodGet) {
+		return
+	}
+	q := r.URL.Query()
+	index := q.Get("index")
+	desc := q.Get("desc") == "true" || q.Get("desc") == "1"
+	limit, ok := parseLimit(r)
+	if !ok {
+		writeBadRequest(w, "invalid limit")
+		return
+	}
+	startName, stopName := "gte", "lt"
+	if desc {
+		startName, stopName = "lte", "gt"
+	}
+	_, hasStart := q[startName]
+	_, hasStop := q[stopName]
+	start, stop := q.Get(startName), q.Get(stopName)
+	var cur *cursor
+	if s := q.Get("cursor"); s != "" {
+		if cur, ok = decodeCursor(s); !ok {
+			writeBadRequest(w, "invalid cursor")
+			return
+		}
+		// Continue from the last item, which is skipped below.
+		hasStart = true
+		start = cur.Value
+		if index == "" {
+			start = cur.Key
+		}
+	}
+	var res ScanResponse
+	res.Items = []Item{}
+	err := h.db.View(func(tx *buntdb.Tx) error {
+		var less func(a, b string) bool
+		if cur != nil && index != "" {
+			var err error
+			if less, err = tx.GetLess(index); err != nil {
+				return err
+			}
+		}
+		iter := func(key, val string) bool {
+			if cur != nil {
+				// Skip the items up to and including the last item
+				// of the previous scan. Items with different values
+				// may be equal for the index, such as by case.
+				if cur.passed(less, desc, key, val) {
+					return true
+				}
+				cur = nil
+			}
+			if len(res.Items) == limit {
+				res.Cursor = cursor{Value: res.Items[limit-1].Value,
+					Key: res.Items[limit-1].Key}.encode()
+				return false
+			}
+			res.Items = append(res.Items, Item{Key: key, Value: val,
+				TTL: ttlOf(tx, key)})
+			return true
+		}
+		switch {
+		case !desc && hasStart && hasStop:
+			return tx.AscendRange(index, start, stop, iter)
+		case !desc && hasStart:
+			return tx.AscendGreaterOrEqual(index, start, iter)
+		case !desc && hasStop:
+			return tx.AscendLessThan(index, stop, iter)
+		case !desc:
+			return tx.Ascend(index, iter)
+		case hasStart && hasStop:
+			return tx.DescendRange(index, start, stop, iter)
+		case hasStart:
+			return tx.DescendLessOrEqual(index, start, iter)
+		case hasStop:
+			return tx.DescendGreaterThan(index, stop, iter)
+		default:
+			return tx.Descend(index, iter)
+		}
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, nethttp.StatusOK, res)
+}
+
+func (h *Handler) serveIntersects(w nethttp.ResponseWriter,
+	r *nethttp.Request) {
+	if !methodAllowed(w, r, nethttp.MethodGet) {
+		return
+	}
+	q := r.URL.Query()
+	limit, ok := parseLimit(r)
+	if !ok {
+		writeBadRequest(w, "invalid limit")
+		return
+	}
+	var res ScanResponse
+	res.Items = []Item{}
+	err := h.db.View(func(tx *buntdb.Tx) error {
+		return tx.Intersects(q.Get("index"), q.Get("bounds"),
+			func(key, val string) bool {
+				if len(res.Items) == limit {
+					return false
+				}
+				res.Items = append(res.Items, Item{Key: key, Value: val,
+					TTL: ttlOf(tx, key)})
+				return true
+			})
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, nethttp.StatusOK, res)
+}
+
+func (h *Handler) serveBatch(w nethttp.ResponseWriter, r *nethttp.Request) {
+	if !methodAllowed(w, r, nethttp.MethodPost) {
+		return
+	}
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadRequest(w, err.Error())
+		return
+	}
+	var res BatchResponse
+	failed := -1 // the index of the operation that failed
+	err := h.db.Update(func(tx *buntdb.Tx) error {
+		res.Results = make([]Result, 0, len(req.Ops))
+		for i, op := range req.Ops {
+			result, err := execOp(tx, op)
+			if err != nil {
+				failed = i
+				return err
+			}
+			res.Results = append(res.Results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		if failed == -1 {
+			writeError(w, err)
+			return
+		}
+		// None of the operations were applied.
+		writeJSON(w, statusCode(err), Error{Error: err.Error(), Op: &failed})
+		return
+	}
+	writeJSON(w, nethttp.StatusOK, res)
+}
+
+// execOp executes a single operation of a batch. A "get" or "del" of an item
+// that does not exist is not an error.
+func execOp(tx *buntdb.Tx, op Op) (Result, error) {
+	switch strings.ToLower(op.Op) {
+	case "get":
+		val, err := tx.Get(op.Key)
+		if err == buntdb.ErrNotFound {
+			return Result{}, nil
+		}
+		return Result{Value: val, Found: err == nil}, err
+	case "set":
+		prev, replaced, err := tx.Set(op.Key, op.Value,
+			setOptions(op.TTL, op.NX, op.XX))
+		return Result{Value: prev, Found: replaced}, err
+	case "del":
+		val, err := tx.Delete(op.Key)
+		if err == buntdb.ErrNotFound {
+			return Result{}, nil
+		}
+		return Result{Value: val, Found: err == nil}, err
+	case "incr":
+		n, err := tx.Incr(op.Key, op.Delta)
+		return Result{Value: strconv.FormatInt(n, 10), Found: true}, err
+	case "expire":
+		err := tx.Expire(op.Key, duration(op.TTL))
+		return Result{Found: err == nil}, err
+	case "persist":
+		err := tx.Persist(op.Key)
+		return Result{Found: err == nil}, err
+	}
+	return Result{}, badRequest("unknown op '" + op.Op + "'")
+}
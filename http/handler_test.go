@@ -0,0 +1,335 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+func testHandler(t *testing.T) (*buntdb.DB, *httptest.Server) {
+	db, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, httptest.NewServer(New(db))
+}
+
+// do sends a request and decodes the response into v, returning the status
+// code.
+func do(t *testing.T, ts *httptest.Server, method, path string, body,
+	v interface{}) int {
+	var rd *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rd = bytes.NewReader(data)
+	} else {
+		rd = bytes.NewReader(nil)
+	}
+	req, err := nethttp.NewRequest(method, ts.URL+path, rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := nethttp.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestKeys(t *testing.T) {
+	db, ts := testHandler(t)
+	defer db.Close()
+	defer ts.Close()
+
+	var set SetResponse
+	if code := do(t, ts, "PUT", "/keys/user:1",
+		SetRequest{Value: "tom"}, &set); code != 200 || set.Replaced {
+		t.Fatalf("expecting '%v', got '%v'", 200, code)
+	}
+	do(t, ts, "PUT", "/keys/user:1", SetRequest{Value: "jane"}, &set)
+	if !set.Replaced || set.Previous != "tom" {
+		t.Fatalf("expecting '%v', got '%v'", "tom", set.Previous)
+	}
+	var e Error
+	if code := do(t, ts, "PUT", "/keys/user:1",
+		SetRequest{Value: "bob", NX: true}, &e); code != 412 {
+		t.Fatalf("expecting '%v', got '%v'", 412, code)
+	}
+	var item Item
+	do(t, ts, "GET", "/keys/user:1", nil, &item)
+	if item.Value != "jane" || item.TTL != nil {
+		t.Fatalf("expecting '%v', got '%v'", "jane", item.Value)
+	}
+
+	do(t, ts, "PUT", "/keys/user:2", SetRequest{Value: "bob", TTL: 60}, nil)
+	do(t, ts, "GET", "/keys/user:2", nil, &item)
+	if item.TTL == nil || *item.TTL <= 59 || *item.TTL > 60 {
+		t.Fatalf("expecting a ttl of '%v', got '%v'", 60, item.TTL)
+	}
+	var ttl TTLResponse
+	do(t, ts, "GET", "/ttl/user:2", nil, &ttl)
+	if ttl.TTL <= 59 || ttl.TTL > 60 {
+		t.Fatalf("expecting '%v', got '%v'", 60, ttl.TTL)
+	}
+	do(t, ts, "GET", "/ttl/user:1", nil, &ttl)
+	if ttl.TTL != -1 {
+		t.Fatalf("expecting '%v', got '%v'", -1, ttl.TTL)
+	}
+
+	if code := do(t, ts, "DELETE", "/keys/user:1", nil, &item); code != 200 ||
+		item.Value != "jane" {
+		t.Fatalf("expecting '%v', got '%v'", "jane", item.Value)
+	}
+	if code := do(t, ts, "GET", "/keys/user:1", nil, &e); code != 404 ||
+		e.Error != buntdb.ErrNotFound.Error() {
+		t.Fatalf("expecting '%v', got '%v'", 404, code)
+	}
+	if code := do(t, ts, "DELETE", "/keys/user:1", nil, &e); code != 404 {
+		t.Fatalf("expecting '%v', got '%v'", 404, code)
+	}
+	if code := do(t, ts, "POST", "/keys/user:1", nil, &e); code != 405 {
+		t.Fatalf("expecting '%v', got '%v'", 405, code)
+	}
+}
+
+func TestScan(t *testing.T) {
+	db, ts := testHandler(t)
+	defer db.Close()
+	defer ts.Close()
+	if err := db.CreateIndex("ages", "user:*", buntdb.IndexInt); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSpatialIndex("fleet", "fleet:*", buntdb.IndexRect); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("names", "name:*", buntdb.IndexString); err != nil {
+		t.Fatal(err)
+	}
+	err := db.Update(func(tx *buntdb.Tx) error {
+		for i, age := range []int{35, 20, 35, 51, 20, 42, 35} {
+			_, _, err := tx.Set(fmt.Sprintf("user:%d", i), fmt.Sprint(age), nil)
+			if err != nil {
+				return err
+			}
+		}
+		// the names are equal for the case-insensitive index
+		for i, name := range []string{"A", "a", "A", "b"} {
+			_, _, err := tx.Set(fmt.Sprintf("name:%d", i), name, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var indexes IndexesResponse
+	do(t, ts, "GET", "/indexes", nil, &indexes)
+	if !reflect.DeepEqual(indexes.Indexes, []string{"ages", "fleet", "names"}) {
+		t.Fatalf("expecting '%v', got '%v'", "[ages fleet names]", indexes.Indexes)
+	}
+
+	// scan collects the keys of all the pages of a scan.
+	scan := func(query string) (keys []string, pages int) {
+		var cursor string
+		for {
+			q := query
+			if cursor != "" {
+				q += "&cursor=" + url.QueryEscape(cursor)
+			}
+			var res ScanResponse
+			if code := do(t, ts, "GET", "/scan?"+q, nil, &res); code != 200 {
+				t.Fatalf("expecting '%v', got '%v'", 200, code)
+			}
+			for _, item := range res.Items {
+				keys = append(keys, item.Key)
+			}
+			pages++
+			if res.Cursor == "" {
+				return keys, pages
+			}
+			if pages > 20 {
+				t.Fatalf("%s: the scan does not end, got '%v'", query, keys)
+			}
+			cursor = res.Cursor
+		}
+	}
+	tests := []struct {
+		query string
+		keys  string
+		pages int
+	}{
+		{"index=ages", "user:1,user:4,user:0,user:2,user:6,user:5,user:3", 1},
+		{"index=ages&limit=2", "user:1,user:4,user:0,user:2,user:6,user:5,user:3", 4},
+		{"index=ages&limit=3&gte=35&lt=51", "user:0,user:2,user:6,user:5", 2},
+		{"index=ages&limit=2&desc=true", "user:3,user:5,user:6,user:2,user:0,user:4,user:1", 4},
+		{"index=ages&limit=1&desc=true&lte=35&gt=20", "user:6,user:2,user:0", 3},
+		{"limit=3&gte=user:2", "user:2,user:3,user:4,user:5,user:6", 2},
+		{"limit=3&gte=user:&desc=false", "user:0,user:1,user:2,user:3,user:4,user:5,user:6", 3},
+		{"limit=3&gt=name:~&desc=true", "user:6,user:5,user:4,user:3,user:2,user:1,user:0", 3},
+		{"index=names&limit=1", "name:0,name:1,name:2,name:3", 4},
+		{"index=names&limit=2&desc=true", "name:3,name:2,name:1,name:0", 2},
+		{"index=names&limit=1&gte=a&lt=b", "name:0,name:1,name:2", 3},
+	}
+	for _, test := range tests {
+		keys, pages := scan(test.query)
+		if strings.Join(keys, ",") != test.keys || pages != test.pages {
+			t.Fatalf("%s: expecting '%v' in %d pages, got '%v' in %d pages",
+				test.query, test.keys, test.pages, strings.Join(keys, ","), pages)
+		}
+	}
+
+	var e Error
+	if code := do(t, ts, "GET", "/scan?cursor=!", nil, &e); code != 400 {
+		t.Fatalf("expecting '%v', got '%v'", 400, code)
+	}
+	if code := do(t, ts, "GET", "/scan?limit=0", nil, &e); code != 400 {
+		t.Fatalf("expecting '%v', got '%v'", 400, code)
+	}
+	if code := do(t, ts, "GET", "/scan?index=none", nil, &e); code != 404 {
+		t.Fatalf("expecting '%v', got '%v'", 404, code)
+	}
+}
+
+func TestIntersects(t *testing.T) {
+	db, ts := testHandler(t)
+	defer db.Close()
+	defer ts.Close()
+	if err := db.CreateSpatialIndex("fleet", "fleet:*", buntdb.IndexRect); err != nil {
+		t.Fatal(err)
+	}
+	err := db.Update(func(tx *buntdb.Tx) error {
+		tx.Set("fleet:0:pos", "[-115.567 33.532]", nil)
+		tx.Set("fleet:1:pos", "[-116.671 35.735]", nil)
+		tx.Set("fleet:2:pos", "[-113.902 31.234]", nil)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res ScanResponse
+	do(t, ts, "GET", "/intersects?index=fleet&bounds="+
+		url.QueryEscape("[-117 30],[-112 36]"), nil, &res)
+	if len(res.Items) != 3 {
+		t.Fatalf("expecting '%v', got '%v'", 3, len(res.Items))
+	}
+	do(t, ts, "GET", "/intersects?index=fleet&limit=1&bounds="+
+		url.QueryEscape("[-116 33],[-115 34]"), nil, &res)
+	if len(res.Items) != 1 || res.Items[0].Key != "fleet:0:pos" {
+		t.Fatalf("expecting '%v', got '%v'", "fleet:0:pos", res.Items)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	db, ts := testHandler(t)
+	defer db.Close()
+	defer ts.Close()
+
+	var res BatchResponse
+	code := do(t, ts, "POST", "/batch", BatchRequest{Ops: []Op{
+		{Op: "set", Key: "a", Value: "1"},
+		{Op: "incr", Key: "a", Delta: 9},
+		{Op: "set", Key: "b", Value: "2", TTL: 60},
+		{Op: "get", Key: "a"},
+		{Op: "del", Key: "c"},
+		{Op: "persist", Key: "b"},
+	}}, &res)
+	if code != 200 {
+		t.Fatalf("expecting '%v', got '%v'", 200, code)
+	}
+	expect := []Result{{}, {Value: "10", Found: true}, {}, {Value: "10",
+		Found: true}, {}, {Found: true}}
+	if !reflect.DeepEqual(res.Results, expect) {
+		t.Fatalf("expecting '%v', got '%v'", expect, res.Results)
+	}
+
+	// A failed operation rolls back the whole batch.
+	var e Error
+	code = do(t, ts, "POST", "/batch", BatchRequest{Ops: []Op{
+		{Op: "set", Key: "a", Value: "11"},
+		{Op: "del", Key: "b"},
+		{Op: "set", Key: "d", Value: "4", NX: true},
+		{Op: "set", Key: "a", Value: "12", NX: true},
+	}}, &e)
+	if code != 412 || e.Op == nil || *e.Op != 3 {
+		t.Fatalf("expecting '%v', got '%v'", 412, code)
+	}
+	code = do(t, ts, "POST", "/batch", BatchRequest{Ops: []Op{
+		{Op: "rename", Key: "a"},
+	}}, &e)
+	if code != 400 || e.Op == nil || *e.Op != 0 {
+		t.Fatalf("expecting '%v', got '%v'", 400, code)
+	}
+	err := db.View(func(tx *buntdb.Tx) error {
+		var keys []string
+		tx.Ascend("", func(key, val string) bool {
+			keys = append(keys, key+"="+val)
+			return true
+		})
+		if strings.Join(keys, ",") != "a=10,b=2" {
+			t.Fatalf("expecting '%v', got '%v'", "a=10,b=2", keys)
+		}
+		if ttl, _ := tx.TTL("b"); ttl != -1 {
+			t.Fatalf("expecting '%v', got '%v'", -1, ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchPersistent(t *testing.T) {
+	os.RemoveAll("data.db")
+	db, err := buntdb.Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("data.db")
+	ts := httptest.NewServer(New(db))
+	do(t, ts, "POST", "/batch", BatchRequest{Ops: []Op{
+		{Op: "set", Key: "a", Value: "1", TTL: 60},
+		{Op: "set", Key: "b", Value: "2"},
+	}}, nil)
+	ts.Close()
+	db.Close()
+
+	db, err = buntdb.Open("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	db.View(func(tx *buntdb.Tx) error {
+		n, _ = tx.Len()
+		ttl, _ := tx.TTL("a")
+		if ttl < 59*time.Second {
+			t.Fatalf("expecting '%v', got '%v'", time.Minute, ttl)
+		}
+		return nil
+	})
+	if n != 2 {
+		t.Fatalf("expecting '%v', got '%v'", 2, n)
+	}
+}
@@ -0,0 +1,439 @@
+package buntdb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/btree"
+)
+
+// The replication protocol uses the same records as the aof. The follower
+// sends a "sync <seq>" record with the sequence number of its last
+// transaction. The leader replies with the transactions that follow, each
+// wrapped in MULTI and EXEC and beginning with a "seq" record. When those
+// transactions are no longer available, the leader first sends a snapshot,
+// which is a transaction that begins with a "snapshot" record followed by the
+// output of Save().
+
+// replica is the state of a database that follows a leader.
+type replica struct {
+	conn net.Conn      // the connection to the leader
+	done chan struct{} // closed when Follow() returns
+}
+
+// errPromoted is used to stop the replication after a Promote().
+var errPromoted = errors.New("promoted")
+
+// committed wakes up the followers that are waiting for new transactions. It
+// must be called with the write lock held.
+func (db *DB) committed() {
+	close(db.commitc)
+	db.commitc = make(chan struct{})
+}
+
+// ServeFollower sends the database to a follower that is connected over conn,
+// and continues to send every committed transaction until the follower
+// disconnects or the database is closed. The follower is a database that
+// called Follow() with the other end of the connection. The connection is
+// closed when this function returns.
+//
+// A new follower receives a snapshot, which includes the persisted index
+// definitions. A follower that has fallen behind receives the transactions
+// that it missed, or a snapshot when they are no longer available, such as
+// after a Shrink() of the leader. Indexes that are created or dropped after
+// the snapshot are not sent to the follower.
+func (db *DB) ServeFollower(conn net.Conn) error {
+	defer func() { _ = conn.Close() }()
+	rd := bufio.NewReader(conn)
+	parts, err := loadReadCommand(rd)
+	if err != nil {
+		if err == errValidEOF {
+			return io.EOF
+		}
+		return err
+	}
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "sync" {
+		return ErrInvalid
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return ErrInvalid
+	}
+	// The follower does not send anything else, a read only returns when
+	// the follower disconnects.
+	gone := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, rd)
+		close(gone)
+	}()
+	wr := bufio.NewWriter(conn)
+	for {
+		db.mu.RLock()
+		if db.closed {
+			db.mu.RUnlock()
+			return ErrDatabaseClosed
+		}
+		commitc := db.commitc
+		last := db.seq
+		db.mu.RUnlock()
+		if seq != last {
+			err = ErrCompacted
+			if seq > 0 && seq < last {
+				seq, err = db.writeChanges(wr, seq)
+			}
+			if err == ErrCompacted {
+				// A new follower, a follower that is too far behind,
+				// or one that has transactions that the leader does
+				// not know about.
+				seq, err = db.writeSnapshot(wr)
+			}
+			if err != nil {
+				return err
+			}
+			if err := wr.Flush(); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-commitc:
+		case <-gone:
+			return io.EOF
+		}
+	}
+}
+
+// writeChanges writes the transactions that follow seq, and returns the
+// sequence number of the last transaction that was written.
+func (db *DB) writeChanges(wr *bufio.Writer, seq uint64) (uint64, error) {
+	var tseq uint64 // the transaction being written
+	err := db.ChangesSince(seq, func(c Change) bool {
+		if c.Seq != tseq {
+			if tseq != 0 {
+				writeMultiBulk(wr, "exec")
+			}
+			writeMultiBulk(wr, "multi")
+			writeMultiBulk(wr, "seq", strconv.FormatUint(c.Seq, 10))
+			tseq = c.Seq
+		}
+		item := changeItem(c)
+		switch c.Type {
+		case ChangeDelete:
+			item.writeDeleteTo(wr)
+		case ChangeTTL:
+			item.writeExpireTo(wr)
+		default:
+			item.writeSetTo(wr)
+		}
+		return true
+	})
+	if tseq == 0 {
+		return seq, err
+	}
+	writeMultiBulk(wr, "exec")
+	return tseq, err
+}
+
+// writeSnapshot writes a snapshot of the database, and returns the sequence
+// number of the last transaction in the snapshot.
+func (db *DB) writeSnapshot(wr *bufio.Writer) (uint64, error) {
+	writeMultiBulk(wr, "multi")
+	writeMultiBulk(wr, "snapshot")
+	seq, err := db.save(wr)
+	if err != nil {
+		return 0, err
+	}
+	writeMultiBulk(wr, "exec")
+	return seq, nil
+}
+
+// Follow makes the database a follower of the leader that is connected over
+// conn, which is served by ServeFollower() on the leader. The database
+// receives a snapshot of the leader, unless it already has the transactions
+// of the leader, such as from a previous Follow(), and then every transaction
+// that the leader commits. The transactions are written to the database file
+// like any other transaction.
+//
+// The database is read-only while following, and read/write transactions
+// return ErrTxNotWritable. Items that expire are not removed by the follower,
+// they are removed when the leader removes them. A follower must not follow a
+// different leader than the one it received the snapshot from, unless that
+// leader was a follower of the same leader.
+//
+// This function blocks until the connection is closed, which returns the error
+// that closed it, or until Promote() is called, which returns nil. The
+// database stays read-only until it's promoted, even when the connection is
+// lost, thus it may follow the leader again with a new connection. The
+// connection is closed when this function returns. ErrShrinkInProcess is
+// returned when a snapshot is received while the database is shrinking.
+func (db *DB) Follow(conn net.Conn) error {
+	defer func() { _ = conn.Close() }()
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrDatabaseClosed
+	}
+	if db.config.ReadOnly {
+		db.mu.Unlock()
+		return ErrTxNotWritable
+	}
+	if db.replica != nil {
+		select {
+		case <-db.replica.done:
+			// A previous Follow() has lost its connection.
+		default:
+			db.mu.Unlock()
+			return ErrInvalidOperation
+		}
+	}
+	r := &replica{conn: conn, done: make(chan struct{})}
+	db.replica = r
+	seq := db.seq
+	db.mu.Unlock()
+	defer close(r.done)
+
+	wr := bufio.NewWriter(conn)
+	writeMultiBulk(wr, "sync", strconv.FormatUint(seq, 10))
+	err := wr.Flush()
+	if err == nil {
+		err = db.readReplication(r, bufio.NewReader(conn))
+	}
+	db.mu.RLock()
+	closed, promoted := db.closed, db.replica != r
+	db.mu.RUnlock()
+	if closed {
+		return ErrDatabaseClosed
+	} else if promoted {
+		return nil
+	}
+	return err
+}
+
+// Promote stops following the leader and makes the database writable, such
+// as when the leader has failed. ErrInvalidOperation is returned when the
+// database is not a follower.
+func (db *DB) Promote() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrDatabaseClosed
+	}
+	r := db.replica
+	if r == nil {
+		db.mu.Unlock()
+		return ErrInvalidOperation
+	}
+	db.replica = nil
+	db.mu.Unlock()
+	_ = r.conn.Close()
+	<-r.done
+	return nil
+}
+
+// readReplication reads and applies the transactions from the leader until
+// an error occurs. The aof reader is not used because it reads ahead, which
+// would wait for the next transaction before applying the current one.
+func (db *DB) readReplication(r *replica, rd *bufio.Reader) error {
+	var cmds [][]string // the commands in the current transaction
+	for {
+		parts, err := loadReadCommand(rd)
+		if err != nil {
+			if err == errValidEOF {
+				// The leader closed the connection.
+				return io.EOF
+			}
+			return err
+		}
+		if len(parts) == 0 {
+			return ErrInvalid
+		}
+		switch strings.ToLower(parts[0]) {
+		case "multi":
+			cmds = nil
+		case "exec":
+			if err := db.replicate(r, cmds); err != nil {
+				return err
+			}
+		default:
+			cmds = append(cmds, parts)
+		}
+	}
+}
+
+// replicate applies a transaction that was received from the leader.
+func (db *DB) replicate(r *replica, cmds [][]string) error {
+	if len(cmds) == 0 || len(cmds[0]) == 0 {
+		return ErrInvalid
+	}
+	switch strings.ToLower(cmds[0][0]) {
+	case "snapshot":
+		if len(cmds[0]) != 1 {
+			return ErrInvalid
+		}
+		return db.loadSnapshot(r, cmds[1:])
+	case "seq":
+		if len(cmds[0]) != 2 {
+			return ErrInvalid
+		}
+		seq, err := strconv.ParseUint(cmds[0][1], 10, 64)
+		if err != nil {
+			return ErrInvalid
+		}
+		changes := make([]Change, 0, len(cmds)-1)
+		for _, parts := range cmds[1:] {
+			c, err := loadChange(seq, parts)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, c)
+		}
+		return db.applyChanges(r, seq, changes)
+	}
+	return ErrInvalid
+}
+
+// applyChanges commits the changes of a transaction from the leader, using the
+// same sequence number as the leader.
+func (db *DB) applyChanges(r *replica, seq uint64, changes []Change) error {
+	tx, err := db.begin(context.Background(), true, true)
+	if err != nil {
+		return err
+	}
+	if db.replica != r {
+		_ = tx.Rollback()
+		return errPromoted
+	}
+	if seq <= db.seq {
+		// Already applied.
+		return tx.Rollback()
+	}
+	for _, c := range changes {
+		if err := tx.Apply(c); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.commit(seq)
+}
+
+// loadSnapshot replaces the contents of the database with a snapshot from the
+// leader. The indexes of the database are kept. The snapshot is written to a
+// new file that replaces the database file, thus the previous contents are
+// kept when the snapshot cannot be written.
+func (db *DB) loadSnapshot(r *replica, cmds [][]string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	if db.replica != r {
+		return errPromoted
+	}
+	if db.persist && db.shrinking {
+		// The shrink would replace the file with the previous contents.
+		return ErrShrinkInProcess
+	}
+	defer db.publish()
+	// The previous contents are restored when the snapshot fails.
+	keys, exps, memsize := db.keys, db.exps, db.memsize
+	seq, seqbase, ring := db.seq, db.seqbase, db.ring
+	idxs := make(map[*index]index, len(db.idxs))
+	for _, idx := range db.idxs {
+		idxs[idx] = *idx
+	}
+	err := func() error {
+		db.keys = btree.New(db.config.BTreeDegree, nil)
+		db.exps = btree.New(db.config.BTreeDegree, &exctx{db})
+		db.memsize = 0
+		for _, idx := range db.idxs {
+			db.buildIndex(idx)
+		}
+		db.seq, db.seqbase, db.ring = 0, 0, nil
+		for _, parts := range cmds {
+			if err := db.loadCommand(parts); err != nil {
+				return err
+			}
+		}
+		if db.persist {
+			return db.replaceFile()
+		}
+		return nil
+	}()
+	if err != nil {
+		db.keys, db.exps, db.memsize = keys, exps, memsize
+		db.seq, db.seqbase, db.ring = seq, seqbase, ring
+		for idx, prev := range idxs {
+			*idx = prev
+			idx.dirty = true
+		}
+		return err
+	}
+	db.committed()
+	return nil
+}
+
+// replaceFile replaces the database file with a new file that contains the
+// current items. Like Shrink, the new file is written and synced to a
+// temporary file which is then renamed to the database file.
+func (db *DB) replaceFile() error {
+	if err := db.bufw.Flush(); err != nil {
+		return err
+	}
+	tmpname := db.path + ".tmp"
+	f, err := os.OpenFile(tmpname, os.O_CREATE|os.O_RDWR|os.O_TRUNC,
+		db.config.FileMode)
+	if err != nil {
+		return err
+	}
+	file, bufw := db.file, db.bufw
+	defer func() {
+		if f != nil {
+			// The files were not swapped.
+			db.file, db.bufw = file, bufw
+			_ = f.Close()
+			_ = os.RemoveAll(tmpname)
+		}
+	}()
+	if err := lockFile(f, false); err != nil {
+		return err
+	}
+	db.file, db.bufw = f, bufio.NewWriter(f)
+	err = db.writeTx(func(wr *bufio.Writer) {
+		if db.seqbase > 0 {
+			writeMultiBulk(wr, "compacted", strconv.FormatUint(db.seqbase, 10))
+		}
+		for _, idx := range db.idxs {
+			if idx.fname != "" {
+				idx.writeCreateTo(wr)
+			}
+		}
+		db.keys.Ascend(func(item btree.Item) bool {
+			item.(*dbItem).writeSetTo(wr)
+			return true
+		})
+	})
+	if err != nil {
+		return err
+	}
+	pos, err := f.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpname, db.path); err != nil {
+		return err
+	}
+	// The previous file is closed after the rename, which releases its lock.
+	_ = file.Close()
+	f = nil
+	db.lastaofsz = int(pos)
+	return nil
+}
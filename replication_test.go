@@ -0,0 +1,380 @@
+package buntdb
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitSeq waits for the database to reach the sequence number.
+func waitSeq(t *testing.T, db *DB, seq uint64) {
+	t.Helper()
+	start := time.Now()
+	for {
+		cur, err := db.Seq()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cur == seq {
+			return
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("expecting seq '%v', got '%v'", seq, cur)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// dumpItems returns the keys, values and expiration of all items.
+func dumpItems(t *testing.T, db *DB) string {
+	t.Helper()
+	var items []string
+	if err := db.View(func(tx *Tx) error {
+		return tx.Ascend("", func(key, val string) bool {
+			ttl, _ := tx.TTL(key)
+			items = append(items, fmt.Sprintf("%s=%s(%v)", key, val,
+				ttl > 0))
+			return true
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(items, ",")
+}
+
+// follow connects the follower to the leader over a pipe. The returned
+// channels receive the errors of ServeFollower and Follow.
+func follow(leader, follower *DB) (served, followed chan error) {
+	c1, c2 := net.Pipe()
+	served, followed = make(chan error, 1), make(chan error, 1)
+	go func() { served <- leader.ServeFollower(c1) }()
+	go func() { followed <- follower.Follow(c2) }()
+	return served, followed
+}
+
+func TestReplication(t *testing.T) {
+	for _, path := range []string{"leader.db", "follower.db"} {
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatal(err)
+		}
+		defer func(path string) { _ = os.RemoveAll(path) }(path)
+	}
+	leader, err := Open("leader.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = leader.Close() }()
+	follower, err := Open("follower.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = follower.Close() }()
+	if err := leader.CreateIndex("vals", "*", IndexString); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Update(func(tx *Tx) error {
+		for i := 0; i < 5; i++ {
+			_, _, err := tx.Set(fmt.Sprintf("key:%d", i), fmt.Sprintf("%d", 9-i), nil)
+			if err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set("tmp", "x", &SetOptions{Expires: true, TTL: time.Hour})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	served, followed := follow(leader, follower)
+	waitSeq(t, follower, 1)
+	if dumpItems(t, follower) != dumpItems(t, leader) {
+		t.Fatalf("expecting '%v', got '%v'", dumpItems(t, leader),
+			dumpItems(t, follower))
+	}
+	// the index definition is part of the snapshot
+	var keys []string
+	if err := follower.View(func(tx *Tx) error {
+		return tx.Ascend("vals", func(key, val string) bool {
+			keys = append(keys, key)
+			return len(keys) < 2
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "key:4,key:3" {
+		t.Fatalf("expecting '%v', got '%v'", "key:4,key:3", keys)
+	}
+	if err := follower.Update(func(tx *Tx) error { return nil }); err != ErrTxNotWritable {
+		t.Fatalf("expecting '%v', got '%v'", ErrTxNotWritable, err)
+	}
+
+	// the following transactions are streamed
+	if err := leader.Update(func(tx *Tx) error {
+		if _, err := tx.Delete("key:0"); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("key:1", "new", nil); err != nil {
+			return err
+		}
+		// created and deleted by the same transaction
+		if _, _, err := tx.Set("key:5", "5", nil); err != nil {
+			return err
+		}
+		if _, err := tx.Delete("key:5"); err != nil {
+			return err
+		}
+		return tx.Persist("tmp")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("sliding", "s", &SetOptions{Expires: true,
+			TTL: time.Hour, Sliding: true})
+		if err != nil {
+			return err
+		}
+		return tx.Expire("key:2", time.Hour)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitSeq(t, follower, 3)
+	expect := "key:1=new(false),key:2=7(true),key:3=6(false),key:4=5(false),sliding=s(true),tmp=x(false)"
+	if items := dumpItems(t, follower); items != expect {
+		t.Fatalf("expecting '%v', got '%v'", expect, items)
+	}
+	sliding := func() time.Duration {
+		if item := follower.get("sliding"); item != nil && item.opts != nil {
+			return item.opts.ttl
+		}
+		return 0
+	}
+	if ttl := sliding(); ttl != time.Hour {
+		t.Fatalf("expecting '%v', got '%v'", time.Hour, ttl)
+	}
+
+	// the leader fails
+	if err := leader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrDatabaseClosed {
+		t.Fatalf("expecting '%v', got '%v'", ErrDatabaseClosed, err)
+	}
+	if err := <-followed; err != io.EOF {
+		t.Fatalf("expecting '%v', got '%v'", io.EOF, err)
+	}
+	if err := follower.Update(func(tx *Tx) error { return nil }); err != ErrTxNotWritable {
+		t.Fatalf("expecting '%v', got '%v'", ErrTxNotWritable, err)
+	}
+	if err := follower.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Promote(); err != ErrInvalidOperation {
+		t.Fatalf("expecting '%v', got '%v'", ErrInvalidOperation, err)
+	}
+	if err := follower.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key:6", "3", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replicated transactions are in the file of the follower
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+	follower, err = Open("follower.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = strings.Replace(expect, ",sliding", ",key:6=3(false),sliding", 1)
+	if items := dumpItems(t, follower); items != expect {
+		t.Fatalf("expecting '%v', got '%v'", expect, items)
+	}
+	if ttl := sliding(); ttl != time.Hour {
+		t.Fatalf("expecting '%v', got '%v'", time.Hour, ttl)
+	}
+	if seq, _ := follower.Seq(); seq != 4 {
+		t.Fatalf("expecting '%v', got '%v'", 4, seq)
+	}
+}
+
+func TestReplicationResume(t *testing.T) {
+	for _, path := range []string{"leader.db", "follower.db"} {
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatal(err)
+		}
+		defer func(path string) { _ = os.RemoveAll(path) }(path)
+	}
+	// The leader only keeps the last transaction in memory, thus the older
+	// ones are read from the file.
+	config := DefaultConfig()
+	config.ChangeRingSize = 1
+	leader, err := OpenWithConfig("leader.db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = leader.Close() }()
+	follower, err := Open("follower.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = follower.Close() }()
+	set := func(key, val string) {
+		if err := leader.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(key, val, nil)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("a", "1")
+
+	// follow over loopback tcp
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	served := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { served <- leader.ServeFollower(conn) }()
+		}
+	}()
+	connect := func() chan error {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		followed := make(chan error, 1)
+		go func() { followed <- follower.Follow(conn) }()
+		return followed
+	}
+	followed := connect()
+	waitSeq(t, follower, 1)
+	if err := follower.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-followed; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != io.EOF {
+		t.Fatalf("expecting '%v', got '%v'", io.EOF, err)
+	}
+
+	// the follower only receives the missing transactions
+	set("b", "2")
+	set("c", "3")
+	followed = connect()
+	waitSeq(t, follower, 3)
+	var changes []string
+	if err := follower.ChangesSince(1, func(c Change) bool {
+		changes = append(changes, fmt.Sprintf("%d:%s", c.Seq, c.Key))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(changes, ",") != "2:b,3:c" {
+		t.Fatalf("expecting '%v', got '%v'", "2:b,3:c", changes)
+	}
+	c1, c2 := net.Pipe()
+	defer func() { _ = c1.Close() }()
+	if err := follower.Follow(c2); err != ErrInvalidOperation {
+		t.Fatalf("expecting '%v', got '%v'", ErrInvalidOperation, err)
+	}
+	if err := follower.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	<-followed
+	<-served
+
+	// a snapshot is sent when the missing transactions were compacted
+	set("d", "4")
+	if err := leader.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	set("e", "5")
+	followed = connect()
+	waitSeq(t, follower, 5)
+	if items := dumpItems(t, follower); items != dumpItems(t, leader) {
+		t.Fatalf("expecting '%v', got '%v'", dumpItems(t, leader), items)
+	}
+	if err := follower.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	<-followed
+}
+
+func TestReplicationSnapshotFailure(t *testing.T) {
+	if err := os.RemoveAll("follower.db"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll("follower.db") }()
+	db, err := Open("follower.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	if err := db.CreateIndex("vals", "*", IndexString); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("a", "1", nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r := &replica{done: make(chan struct{})}
+	db.replica = r
+	snapshot := [][]string{{"set", "b", "2"}}
+	// the snapshot is refused while the database is shrinking
+	db.shrinking = true
+	if err := db.loadSnapshot(r, snapshot); err != ErrShrinkInProcess {
+		t.Fatalf("expecting '%v', got '%v'", ErrShrinkInProcess, err)
+	}
+	db.shrinking = false
+	// an invalid snapshot keeps the previous contents
+	if err := db.loadSnapshot(r, append(snapshot, []string{"junk"})); err == nil {
+		t.Fatal("expecting an error")
+	}
+	if s := dumpItems(t, db); s != "a=1(false)" {
+		t.Fatalf("expecting '%v', got '%v'", "a=1(false)", s)
+	}
+	var vals []string
+	if err := db.View(func(tx *Tx) error {
+		return tx.Ascend("vals", func(key, val string) bool {
+			vals = append(vals, val)
+			return true
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(vals, ",") != "1" {
+		t.Fatalf("expecting '%v', got '%v'", "1", strings.Join(vals, ","))
+	}
+	if err := db.loadSnapshot(r, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("follower.db.tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expecting the temporary file to be removed, got '%v'", err)
+	}
+	db.replica = nil
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("follower.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := dumpItems(t, db); s != "b=2(false)" {
+		t.Fatalf("expecting '%v', got '%v'", "b=2(false)", s)
+	}
+}
@@ -0,0 +1,353 @@
+package buntdb
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	rtreeMaxDims    = 20 // the maximum number of dimensions of a rect
+	rtreeMaxEntries = 16 // the maximum number of entries in a node
+	rtreeMinEntries = rtreeMaxEntries * 2 / 5
+)
+
+// rtree is a copy-on-write r-tree of items. The items with a different number
+// of dimensions are kept in separate trees. Like the b-trees, a clone shares
+// its nodes with the original tree, and a shared node is copied the first
+// time that it's changed by either tree. Thus a clone can be searched while
+// the original tree is changed.
+type rtree struct {
+	ctx   *index
+	cow   *rtreeCow
+	roots [rtreeMaxDims]*rnode
+}
+
+// rtreeCow identifies the nodes that a tree is allowed to change in place.
+type rtreeCow struct {
+	_ byte // an empty struct may not have a unique address
+}
+
+// rnode is a node of an r-tree.
+type rnode struct {
+	cow     *rtreeCow
+	leaf    bool
+	entries []rentry
+}
+
+// rentry is an entry of a node. It's a child node in a branch and an item in
+// a leaf.
+type rentry struct {
+	min, max []float64
+	child    *rnode
+	item     *dbItem
+}
+
+// newRTree returns an empty r-tree. The ctx index provides the rects of the
+// items.
+func newRTree(ctx *index) *rtree {
+	return &rtree{ctx: ctx, cow: new(rtreeCow)}
+}
+
+// Clone returns a copy of the tree. The copy is lazy, the nodes are only
+// copied when they are changed. Clone changes the tree, thus it must not be
+// called concurrently with other changes to the tree.
+func (tr *rtree) Clone() *rtree {
+	out := *tr
+	tr.cow, out.cow = new(rtreeCow), new(rtreeCow)
+	return &out
+}
+
+// mutable returns a node that the tree can change, which is a copy of the
+// node when the node is shared with a clone.
+func (tr *rtree) mutable(n *rnode) *rnode {
+	if n.cow == tr.cow {
+		return n
+	}
+	c := &rnode{
+		cow:     tr.cow,
+		leaf:    n.leaf,
+		entries: make([]rentry, len(n.entries), rtreeMaxEntries+1),
+	}
+	copy(c.entries, n.entries)
+	return c
+}
+
+// rectOf returns a copy of the rect of an item, or false when the rect is
+// not valid.
+func (tr *rtree) rectOf(item *dbItem) (min, max []float64, ok bool) {
+	min, max = item.Rect(tr.ctx)
+	if len(min) != len(max) || len(min) < 1 || len(min) > rtreeMaxDims {
+		return nil, nil, false
+	}
+	min = append([]float64(nil), min...)
+	max = append([]float64(nil), max...)
+	return min, max, true
+}
+
+// Insert adds an item to the tree. Items with an invalid rect are ignored.
+func (tr *rtree) Insert(item *dbItem) {
+	min, max, ok := tr.rectOf(item)
+	if !ok {
+		return
+	}
+	d := len(min) - 1
+	root := tr.roots[d]
+	if root == nil {
+		root = &rnode{cow: tr.cow, leaf: true}
+	}
+	root, split := tr.insert(root, rentry{min: min, max: max, item: item})
+	if split != nil {
+		root = &rnode{
+			cow:     tr.cow,
+			entries: []rentry{root.entry(), split.entry()},
+		}
+	}
+	tr.roots[d] = root
+}
+
+// insert adds an entry to the subtree of a node. It returns the changed node
+// and the new sibling of the node when the node was split.
+func (tr *rtree) insert(n *rnode, e rentry) (*rnode, *rnode) {
+	n = tr.mutable(n)
+	if n.leaf {
+		n.entries = append(n.entries, e)
+	} else {
+		i := n.choose(e)
+		child, split := tr.insert(n.entries[i].child, e)
+		n.entries[i] = child.entry()
+		if split != nil {
+			n.entries = append(n.entries, split.entry())
+		}
+	}
+	if len(n.entries) <= rtreeMaxEntries {
+		return n, nil
+	}
+	return n, tr.split(n)
+}
+
+// choose returns the entry of a branch that needs the least enlargement to
+// include the new entry.
+func (n *rnode) choose(e rentry) int {
+	best := 0
+	bestEnl, bestArea := math.Inf(+1), math.Inf(+1)
+	for i := range n.entries {
+		area := area(n.entries[i].min, n.entries[i].max)
+		enl := enlargedArea(n.entries[i].min, n.entries[i].max, e.min, e.max) - area
+		if enl < bestEnl || (enl == bestEnl && area < bestArea) {
+			best, bestEnl, bestArea = i, enl, area
+		}
+	}
+	return best
+}
+
+// split moves half of the entries of an overflowing node to a new node. The
+// entries are divided along the axis where their centers are the most
+// spread out.
+func (tr *rtree) split(n *rnode) *rnode {
+	axis, spread := 0, math.Inf(-1)
+	for a := range n.entries[0].min {
+		lo, hi := math.Inf(+1), math.Inf(-1)
+		for _, e := range n.entries {
+			c := e.min[a] + e.max[a]
+			lo, hi = math.Min(lo, c), math.Max(hi, c)
+		}
+		if hi-lo > spread {
+			axis, spread = a, hi-lo
+		}
+	}
+	sort.SliceStable(n.entries, func(i, j int) bool {
+		a, b := n.entries[i], n.entries[j]
+		return a.min[axis]+a.max[axis] < b.min[axis]+b.max[axis]
+	})
+	half := len(n.entries) / 2
+	sibling := &rnode{
+		cow:     tr.cow,
+		leaf:    n.leaf,
+		entries: make([]rentry, len(n.entries)-half, rtreeMaxEntries+1),
+	}
+	copy(sibling.entries, n.entries[half:])
+	for i := half; i < len(n.entries); i++ {
+		n.entries[i] = rentry{}
+	}
+	n.entries = n.entries[:half]
+	return sibling
+}
+
+// Remove removes an item from the tree.
+func (tr *rtree) Remove(item *dbItem) {
+	min, max, ok := tr.rectOf(item)
+	if !ok {
+		return
+	}
+	d := len(min) - 1
+	if tr.roots[d] == nil {
+		return
+	}
+	var orphans []*dbItem
+	root, ok := tr.remove(tr.roots[d], min, max, item, &orphans)
+	if !ok {
+		return
+	}
+	for !root.leaf && len(root.entries) == 1 {
+		root = root.entries[0].child
+	}
+	if len(root.entries) == 0 {
+		root = nil
+	}
+	tr.roots[d] = root
+	// The items of the nodes that were removed for having too few entries
+	// are added back to the tree.
+	for _, item := range orphans {
+		tr.Insert(item)
+	}
+}
+
+// remove removes an item from the subtree of a node. It returns the changed
+// node and false when the item was not found. The items of underfull child
+// nodes are appended to orphans.
+func (tr *rtree) remove(n *rnode, min, max []float64, item *dbItem,
+	orphans *[]*dbItem) (*rnode, bool) {
+	for i := range n.entries {
+		if n.leaf {
+			if n.entries[i].item != item {
+				continue
+			}
+			n = tr.mutable(n)
+			n.delete(i)
+			return n, true
+		}
+		if !contains(n.entries[i].min, n.entries[i].max, min, max) {
+			continue
+		}
+		child, ok := tr.remove(n.entries[i].child, min, max, item, orphans)
+		if !ok {
+			continue
+		}
+		n = tr.mutable(n)
+		if len(child.entries) < rtreeMinEntries {
+			child.items(orphans)
+			n.delete(i)
+		} else {
+			n.entries[i] = child.entry()
+		}
+		return n, true
+	}
+	return n, false
+}
+
+// delete removes the entry at i from a node that the tree can change.
+func (n *rnode) delete(i int) {
+	copy(n.entries[i:], n.entries[i+1:])
+	n.entries[len(n.entries)-1] = rentry{}
+	n.entries = n.entries[:len(n.entries)-1]
+}
+
+// items appends the items in the subtree of a node.
+func (n *rnode) items(items *[]*dbItem) {
+	for _, e := range n.entries {
+		if n.leaf {
+			*items = append(*items, e.item)
+		} else {
+			e.child.items(items)
+		}
+	}
+}
+
+// entry returns a branch entry for the node with the bounds of its entries.
+func (n *rnode) entry() rentry {
+	e := rentry{child: n}
+	for i, c := range n.entries {
+		if i == 0 {
+			e.min = append([]float64(nil), c.min...)
+			e.max = append([]float64(nil), c.max...)
+			continue
+		}
+		for a := range c.min {
+			e.min[a] = math.Min(e.min[a], c.min[a])
+			e.max[a] = math.Max(e.max[a], c.max[a])
+		}
+	}
+	return e
+}
+
+// Search calls iter for every item that intersects the rect. Trees with
+// more dimensions than the rect are unbounded on the missing dimensions.
+// The search stops when iter returns false.
+func (tr *rtree) Search(min, max []float64, iter func(item *dbItem) bool) {
+	if len(min) != len(max) || len(min) < 1 || len(min) > rtreeMaxDims {
+		return
+	}
+	for d, root := range tr.roots {
+		if root == nil {
+			continue
+		}
+		amin := make([]float64, d+1)
+		amax := make([]float64, d+1)
+		for i := range amin {
+			if i < len(min) {
+				amin[i], amax[i] = min[i], max[i]
+			} else {
+				amin[i], amax[i] = math.Inf(-1), math.Inf(+1)
+			}
+		}
+		if !root.search(amin, amax, iter) {
+			return
+		}
+	}
+}
+
+// search calls iter for the items in the subtree of a node that intersect
+// the rect. It returns false when iter returned false.
+func (n *rnode) search(min, max []float64, iter func(item *dbItem) bool) bool {
+	for _, e := range n.entries {
+		if !intersects(e.min, e.max, min, max) {
+			continue
+		}
+		if n.leaf {
+			if !iter(e.item) {
+				return false
+			}
+		} else if !e.child.search(min, max, iter) {
+			return false
+		}
+	}
+	return true
+}
+
+// area returns the area of a rect.
+func area(min, max []float64) float64 {
+	a := 1.0
+	for i := range min {
+		a *= max[i] - min[i]
+	}
+	return a
+}
+
+// enlargedArea returns the area of the rect that includes both rects.
+func enlargedArea(amin, amax, bmin, bmax []float64) float64 {
+	a := 1.0
+	for i := range amin {
+		a *= math.Max(amax[i], bmax[i]) - math.Min(amin[i], bmin[i])
+	}
+	return a
+}
+
+// contains returns true if the first rect contains the second rect.
+func contains(amin, amax, bmin, bmax []float64) bool {
+	for i := range amin {
+		if bmin[i] < amin[i] || bmax[i] > amax[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// intersects returns true if the rects intersect.
+func intersects(amin, amax, bmin, bmax []float64) bool {
+	for i := range amin {
+		if bmin[i] > amax[i] || bmax[i] < amin[i] {
+			return false
+		}
+	}
+	return true
+}
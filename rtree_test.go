@@ -0,0 +1,90 @@
+package buntdb
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// rtreeKeys returns the sorted keys of the items in a tree that intersect
+// the rect.
+func rtreeKeys(tr *rtree, min, max []float64) string {
+	var keys []string
+	tr.Search(min, max, func(item *dbItem) bool {
+		keys = append(keys, item.key)
+		return true
+	})
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// bruteKeys returns the sorted keys of the items that intersect the rect.
+func bruteKeys(items map[string]*dbItem, min, max []float64) string {
+	var keys []string
+	for key, item := range items {
+		imin, imax := IndexRect(item.val)
+		if intersects(min, max, imin, imax) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func TestRTree(t *testing.T) {
+	rand.Seed(1)
+	tr := newRTree(&index{rect: IndexRect})
+	items := make(map[string]*dbItem)
+	var clone *rtree
+	var cloned map[string]*dbItem
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("%d", rand.Intn(1000))
+		if item, ok := items[key]; ok {
+			tr.Remove(item)
+			delete(items, key)
+		} else {
+			x, y := rand.Float64()*100, rand.Float64()*100
+			item := &dbItem{key: key,
+				val: Rect([]float64{x, y}, []float64{x + rand.Float64(), y})}
+			tr.Insert(item)
+			items[key] = item
+		}
+		if i == 2500 {
+			clone = tr.Clone()
+			cloned = make(map[string]*dbItem)
+			for key, item := range items {
+				cloned[key] = item
+			}
+		}
+	}
+	for _, r := range [][2][]float64{
+		{{0, 0}, {100, 100}},
+		{{10, 10}, {20, 30}},
+		{{50}, {51}},
+		{{-10, -10}, {-1, -1}},
+	} {
+		expect := bruteKeys(items, r[0], r[1])
+		if got := rtreeKeys(tr, r[0], r[1]); got != expect {
+			t.Fatalf("expecting '%v', got '%v'", expect, got)
+		}
+		// the clone is not affected by the later changes
+		expect = bruteKeys(cloned, r[0], r[1])
+		if got := rtreeKeys(clone, r[0], r[1]); got != expect {
+			t.Fatalf("expecting '%v', got '%v'", expect, got)
+		}
+	}
+	for _, item := range items {
+		tr.Remove(item)
+	}
+	for _, root := range tr.roots {
+		if root != nil {
+			t.Fatal("expecting an empty tree")
+		}
+	}
+	if got := rtreeKeys(clone, []float64{0, 0}, []float64{100, 100}); got !=
+		bruteKeys(cloned, []float64{0, 0}, []float64{100, 100}) {
+		t.Fatalf("expecting the clone to keep its items, got '%v'", got)
+	}
+}
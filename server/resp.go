@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits that protect the server from clients that send huge requests.
+const (
+	maxArgs     = 1024 * 1024
+	maxBulkSize = 512 * 1024 * 1024
+)
+
+// errProtocol is returned when the client sends an invalid request.
+var errProtocol = errors.New("protocol error")
+
+// readLine reads a single line that ends with "\r\n" or "\n".
+func readLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// readNumber reads a line that starts with the c byte, followed by a number.
+func readNumber(rd *bufio.Reader, c byte, max int) (int, error) {
+	line, err := readLine(rd)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) == 0 || line[0] != c {
+		return 0, errProtocol
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > max {
+		return 0, errProtocol
+	}
+	return n, nil
+}
+
+// readCommand reads the next command from the client. The command is either
+// a RESP array of bulk strings, which is what redis-cli and the client
+// libraries send, or an inline command that is separated by spaces.
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	c, err := rd.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if c[0] != '*' {
+		// An inline command, such as from telnet.
+		line, err := readLine(rd)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+	n, err := readNumber(rd, '*', maxArgs)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		size, err := readNumber(rd, '$', maxBulkSize)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, errProtocol
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, errProtocol
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+// writer writes RESP replies to the client.
+type writer struct {
+	wr *bufio.Writer
+}
+
+// writeHead writes the type byte and a number, such as an array length.
+func (w *writer) writeHead(c byte, n int) {
+	_ = w.wr.WriteByte(c)
+	_, _ = w.wr.WriteString(strconv.Itoa(n))
+	_, _ = w.wr.WriteString("\r\n")
+}
+
+// writeStatus writes a simple string, such as "OK".
+func (w *writer) writeStatus(s string) {
+	_ = w.wr.WriteByte('+')
+	_, _ = w.wr.WriteString(s)
+	_, _ = w.wr.WriteString("\r\n")
+}
+
+// writeError writes an error. The message should begin with an error code
+// such as "ERR".
+func (w *writer) writeError(msg string) {
+	_ = w.wr.WriteByte('-')
+	_, _ = w.wr.WriteString(strings.NewReplacer("\r", " ", "\n", " ").
+		Replace(msg))
+	_, _ = w.wr.WriteString("\r\n")
+}
+
+// writeInt writes an integer.
+func (w *writer) writeInt(n int64) {
+	_ = w.wr.WriteByte(':')
+	_, _ = w.wr.WriteString(strconv.FormatInt(n, 10))
+	_, _ = w.wr.WriteString("\r\n")
+}
+
+// writeBulk writes a bulk string.
+func (w *writer) writeBulk(s string) {
+	w.writeHead('$', len(s))
+	_, _ = w.wr.WriteString(s)
+	_, _ = w.wr.WriteString("\r\n")
+}
+
+// writeNull writes a null bulk string.
+func (w *writer) writeNull() {
+	_, _ = w.wr.WriteString("$-1\r\n")
+}
+
+// writeArray writes an array of bulk strings.
+func (w *writer) writeArray(items []string) {
+	w.writeHead('*', len(items))
+	for _, item := range items {
+		w.writeBulk(item)
+	}
+}
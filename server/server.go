@@ -0,0 +1,692 @@
+// Package server serves a buntdb database over TCP using the Redis protocol
+// (RESP), which allows for any Redis client, such as redis-cli, to talk to the
+// database.
+//
+// The supported commands are PING, ECHO, QUIT, GET, SET (with the EX, PX, NX,
+// and XX options), DEL, EXISTS, INCR, INCRBY, EXPIRE, PERSIST, TTL, PTTL, KEYS,
+// SCAN, DBSIZE, MULTI, EXEC, DISCARD, and the index commands CREATEINDEX,
+// CREATESPATIALINDEX, DROPINDEX, INDEXES, ASCEND, DESCEND, and INTERSECTS.
+//
+// Every command runs in its own transaction. The commands between MULTI and
+// EXEC run in a single transaction.
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// ErrServerClosed is returned by Serve() and ListenAndServe() after a call to
+// Close().
+var ErrServerClosed = errors.New("server closed")
+
+// Server serves a database over the Redis protocol.
+type Server struct {
+	db     *buntdb.DB
+	mu     sync.Mutex
+	lns    map[net.Listener]bool
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// New returns a server for the database. The database is not closed by the
+// server.
+func New(db *buntdb.DB) *Server {
+	return &Server{
+		db:    db,
+		lns:   make(map[net.Listener]bool),
+		conns: make(map[net.Conn]bool),
+	}
+}
+
+// ListenAndServe listens on the TCP network address addr and then calls
+// Serve() to handle the connections.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts the connections on the listener and handles each one in a new
+// goroutine. The listener is closed when Serve returns.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = ln.Close()
+		return ErrServerClosed
+	}
+	s.lns[ln] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.lns, ln)
+		s.mu.Unlock()
+		_ = ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// Close closes all listeners and connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrServerClosed
+	}
+	s.closed = true
+	for ln := range s.lns {
+		_ = ln.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	return nil
+}
+
+// ServeConn handles the commands of a single connection until the connection
+// is closed, or the client sends QUIT.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	s.conns[conn] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+	rd := bufio.NewReader(conn)
+	w := &writer{wr: bufio.NewWriter(conn)}
+	var multi bool       // a MULTI is in progress
+	var aborted bool     // a command could not be queued
+	var queue [][]string // the commands of the MULTI
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			if err == errProtocol {
+				w.writeError("ERR Protocol error")
+				_ = w.wr.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToLower(args[0]) {
+		case "quit":
+			w.writeStatus("OK")
+			_ = w.wr.Flush()
+			return
+		case "multi":
+			if multi {
+				w.writeError("ERR MULTI calls can not be nested")
+				break
+			}
+			multi, aborted, queue = true, false, nil
+			w.writeStatus("OK")
+		case "discard":
+			if !multi {
+				w.writeError("ERR DISCARD without MULTI")
+				break
+			}
+			multi, queue = false, nil
+			w.writeStatus("OK")
+		case "exec":
+			if !multi {
+				w.writeError("ERR EXEC without MULTI")
+				break
+			}
+			if aborted {
+				w.writeError("EXECABORT Transaction discarded because " +
+					"of previous errors.")
+			} else {
+				s.exec(queue, true, w)
+			}
+			multi, queue = false, nil
+		default:
+			cmd, msg := lookup(args)
+			switch {
+			case cmd == nil:
+				w.writeError(msg)
+				aborted = multi
+			case multi && cmd.notx:
+				w.writeError("ERR " + strings.ToUpper(args[0]) +
+					" is not allowed in MULTI")
+				aborted = true
+			case multi:
+				queue = append(queue, args)
+				w.writeStatus("QUEUED")
+			default:
+				s.exec([][]string{args}, false, w)
+			}
+		}
+		if rd.Buffered() == 0 {
+			// Flush once all pipelined commands have been handled.
+			if err := w.wr.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// exec runs the commands in a single transaction. The commands of a MULTI
+// reply with an array.
+func (s *Server) exec(cmds [][]string, multi bool, w *writer) {
+	if !multi && commands[strings.ToLower(cmds[0][0])].notx {
+		commands[strings.ToLower(cmds[0][0])].fn(s, nil, cmds[0], w)
+		return
+	}
+	// The replies are buffered until the transaction has been committed.
+	var buf bytes.Buffer
+	bw := &writer{wr: bufio.NewWriter(&buf)}
+	if multi {
+		bw.writeHead('*', len(cmds))
+	}
+	var writable bool
+	for _, args := range cmds {
+		writable = writable || commands[strings.ToLower(args[0])].writable
+	}
+	fn := func(tx *buntdb.Tx) error {
+		for _, args := range cmds {
+			commands[strings.ToLower(args[0])].fn(s, tx, args, bw)
+		}
+		return nil
+	}
+	var err error
+	if writable {
+		err = s.db.Update(fn)
+	} else {
+		err = s.db.View(fn)
+	}
+	if err != nil {
+		w.writeError("ERR " + err.Error())
+		return
+	}
+	_ = bw.wr.Flush()
+	_, _ = w.wr.Write(buf.Bytes())
+}
+
+// command is a command that is handled by the server.
+type command struct {
+	arity    int  // number of args, or the negative minimum number of args
+	writable bool // needs a read/write transaction
+	notx     bool // runs outside of a transaction, and not in a MULTI
+	fn       func(s *Server, tx *buntdb.Tx, args []string, w *writer)
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"ping":               {arity: -1, fn: cmdPing},
+		"echo":               {arity: 2, fn: cmdEcho},
+		"command":            {arity: -1, fn: cmdCommand},
+		"get":                {arity: 2, fn: cmdGet},
+		"set":                {arity: -3, writable: true, fn: cmdSet},
+		"del":                {arity: -2, writable: true, fn: cmdDel},
+		"exists":             {arity: -2, fn: cmdExists},
+		"incr":               {arity: 2, writable: true, fn: cmdIncr},
+		"incrby":             {arity: 3, writable: true, fn: cmdIncr},
+		"expire":             {arity: 3, writable: true, fn: cmdExpire},
+		"persist":            {arity: 2, writable: true, fn: cmdPersist},
+		"ttl":                {arity: 2, fn: cmdTTL},
+		"pttl":               {arity: 2, fn: cmdTTL},
+		"keys":               {arity: 2, fn: cmdKeys},
+		"scan":               {arity: -2, fn: cmdScan},
+		"dbsize":             {arity: 1, fn: cmdDBSize},
+		"createindex":        {arity: 4, notx: true, fn: cmdCreateIndex},
+		"createspatialindex": {arity: 3, notx: true, fn: cmdCreateIndex},
+		"dropindex":          {arity: 2, notx: true, fn: cmdDropIndex},
+		"indexes":            {arity: 1, notx: true, fn: cmdIndexes},
+		"ascend":             {arity: -2, fn: cmdScanIndex},
+		"descend":            {arity: -2, fn: cmdScanIndex},
+		"intersects":         {arity: -3, fn: cmdIntersects},
+	}
+}
+
+// lookup returns the command for the args, or an error message when the
+// command is unknown or has the wrong number of arguments.
+func lookup(args []string) (*command, string) {
+	cmd := commands[strings.ToLower(args[0])]
+	if cmd == nil {
+		return nil, "ERR unknown command '" + args[0] + "'"
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) ||
+		(cmd.arity < 0 && len(args) < -cmd.arity) {
+		return nil, "ERR wrong number of arguments for '" +
+			strings.ToLower(args[0]) + "' command"
+	}
+	return cmd, ""
+}
+
+const (
+	errSyntax  = "ERR syntax error"
+	errInteger = "ERR value is not an integer or out of range"
+)
+
+func cmdPing(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	switch len(args) {
+	case 1:
+		w.writeStatus("PONG")
+	case 2:
+		w.writeBulk(args[1])
+	default:
+		w.writeError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func cmdEcho(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	w.writeBulk(args[1])
+}
+
+func cmdCommand(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	// Sent by redis-cli when it starts. An empty reply is fine.
+	w.writeHead('*', 0)
+}
+
+func cmdGet(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	val, err := tx.Get(args[1])
+	if err == buntdb.ErrNotFound {
+		w.writeNull()
+	} else if err != nil {
+		w.writeError("ERR " + err.Error())
+	} else {
+		w.writeBulk(val)
+	}
+}
+
+func cmdSet(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	var opts buntdb.SetOptions
+	for i := 3; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "nx":
+			opts.NX = true
+		case "xx":
+			opts.XX = true
+		case "ex", "px":
+			if i+1 == len(args) {
+				w.writeError(errSyntax)
+				return
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				w.writeError("ERR invalid expire time in 'set' command")
+				return
+			}
+			opts.Expires = true
+			if strings.ToLower(args[i]) == "ex" {
+				opts.TTL = time.Duration(n) * time.Second
+			} else {
+				opts.TTL = time.Duration(n) * time.Millisecond
+			}
+			i++
+		default:
+			w.writeError(errSyntax)
+			return
+		}
+	}
+	if opts.NX && opts.XX {
+		w.writeError(errSyntax)
+		return
+	}
+	_, _, err := tx.Set(args[1], args[2], &opts)
+	if err == buntdb.ErrConditionFailed {
+		w.writeNull()
+	} else if err == buntdb.ErrOutOfMemory {
+		w.writeError("OOM " + err.Error())
+	} else if err != nil {
+		w.writeError("ERR " + err.Error())
+	} else {
+		w.writeStatus("OK")
+	}
+}
+
+func cmdDel(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	var n int64
+	for _, key := range args[1:] {
+		if _, err := tx.Delete(key); err == nil {
+			n++
+		}
+	}
+	w.writeInt(n)
+}
+
+func cmdExists(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	var n int64
+	for _, key := range args[1:] {
+		if _, err := tx.Get(key); err == nil {
+			n++
+		}
+	}
+	w.writeInt(n)
+}
+
+func cmdIncr(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	delta := int64(1)
+	if len(args) == 3 {
+		var err error
+		if delta, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+			w.writeError(errInteger)
+			return
+		}
+	}
+	n, err := tx.Incr(args[1], delta)
+	if errors.Is(err, buntdb.ErrNotNumber) || err == buntdb.ErrInvalidOperation {
+		w.writeError(errInteger)
+	} else if err != nil {
+		w.writeError("ERR " + err.Error())
+	} else {
+		w.writeInt(n)
+	}
+}
+
+func cmdExpire(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		w.writeError(errInteger)
+		return
+	}
+	err = tx.Expire(args[1], time.Duration(n)*time.Second)
+	if err == buntdb.ErrNotFound {
+		w.writeInt(0)
+	} else if err != nil {
+		w.writeError("ERR " + err.Error())
+	} else {
+		w.writeInt(1)
+	}
+}
+
+func cmdPersist(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	if ttl, err := tx.TTL(args[1]); err != nil || ttl < 0 {
+		// The item does not exist or does not expire.
+		w.writeInt(0)
+		return
+	}
+	if err := tx.Persist(args[1]); err != nil {
+		w.writeError("ERR " + err.Error())
+		return
+	}
+	w.writeInt(1)
+}
+
+func cmdTTL(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	ttl, err := tx.TTL(args[1])
+	switch {
+	case err == buntdb.ErrNotFound:
+		w.writeInt(-2)
+	case err != nil:
+		w.writeError("ERR " + err.Error())
+	case ttl < 0:
+		w.writeInt(-1)
+	case strings.ToLower(args[0]) == "pttl":
+		w.writeInt(int64((ttl + time.Millisecond/2) / time.Millisecond))
+	default:
+		w.writeInt(int64((ttl + time.Second/2) / time.Second))
+	}
+}
+
+// expired returns true if the item of the key has expired but has not yet
+// been removed from the database.
+func expired(tx *buntdb.Tx, key string) bool {
+	_, err := tx.TTL(key)
+	return err == buntdb.ErrNotFound
+}
+
+func cmdKeys(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	var keys []string
+	err := tx.AscendKeys(args[1], func(key, val string) bool {
+		if !expired(tx, key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		w.writeError("ERR " + err.Error())
+		return
+	}
+	w.writeArray(keys)
+}
+
+// cmdScan handles "SCAN cursor [MATCH pattern] [COUNT count]". The cursor is
+// "0" for the first call, and otherwise the hex encoded last key that was
+// returned, thus the next keys are found without visiting the previous keys.
+func cmdScan(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	resume := args[1] != "0"
+	last, err := hex.DecodeString(args[1])
+	if resume && err != nil {
+		w.writeError("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", uint64(10)
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			w.writeError(errSyntax)
+			return
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			count, err = strconv.ParseUint(args[i+1], 10, 64)
+			if err != nil || count == 0 {
+				w.writeError(errSyntax)
+				return
+			}
+		default:
+			w.writeError(errSyntax)
+			return
+		}
+	}
+	var keys []string
+	next := "0"
+	iter := func(key, val string) bool {
+		if expired(tx, key) {
+			return true
+		}
+		if uint64(len(keys)) == count {
+			next = hex.EncodeToString([]byte(keys[len(keys)-1]))
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	}
+	if !resume {
+		err = tx.AscendKeys(pattern, iter)
+	} else {
+		err = tx.AscendKeysGreaterThan(pattern, string(last), iter)
+	}
+	if err != nil {
+		w.writeError("ERR " + err.Error())
+		return
+	}
+	w.writeHead('*', 2)
+	w.writeBulk(next)
+	w.writeArray(keys)
+}
+
+func cmdDBSize(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	n, err := tx.Len()
+	if err != nil {
+		w.writeError("ERR " + err.Error())
+		return
+	}
+	w.writeInt(int64(n))
+}
+
+// lessFuncs are the index types for CREATEINDEX.
+var lessFuncs = map[string]func(a, b string) bool{
+	"string": buntdb.IndexString,
+	"binary": buntdb.IndexBinary,
+	"int":    buntdb.IndexInt,
+	"uint":   buntdb.IndexUint,
+	"float":  buntdb.IndexFloat,
+}
+
+// cmdCreateIndex handles "CREATEINDEX name pattern type", where type is one of
+// string, binary, int, uint, or float, and "CREATESPATIALINDEX name pattern".
+func cmdCreateIndex(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	var err error
+	if strings.ToLower(args[0]) == "createspatialindex" {
+		err = s.db.CreateSpatialIndex(args[1], args[2], buntdb.IndexRect)
+	} else {
+		less := lessFuncs[strings.ToLower(args[3])]
+		if less == nil {
+			w.writeError("ERR unknown index type '" + args[3] + "'")
+			return
+		}
+		err = s.db.CreateIndex(args[1], args[2], less)
+	}
+	if err != nil {
+		w.writeError("ERR " + err.Error())
+		return
+	}
+	w.writeStatus("OK")
+}
+
+func cmdDropIndex(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	if err := s.db.DropIndex(args[1]); err != nil {
+		w.writeError("ERR " + err.Error())
+		return
+	}
+	w.writeStatus("OK")
+}
+
+func cmdIndexes(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	names, err := s.db.Indexes()
+	if err != nil {
+		w.writeError("ERR " + err.Error())
+		return
+	}
+	sort.Strings(names)
+	w.writeArray(names)
+}
+
+// collector collects the keys and values of a scan, up to a limit.
+type collector struct {
+	limit int
+	items []string
+}
+
+func (c *collector) iter(key, val string) bool {
+	if c.limit >= 0 && len(c.items)/2 == c.limit {
+		return false
+	}
+	c.items = append(c.items, key, val)
+	return true
+}
+
+// parseLimit parses the "LIMIT n" option that follows the args at i.
+func parseLimit(args []string, i int) (int, bool) {
+	if i+2 != len(args) || strings.ToLower(args[i]) != "limit" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(args[i+1])
+	return n, err == nil && n >= 0
+}
+
+// cmdScanIndex handles "ASCEND index [GTE pivot] [LT pivot] [LIMIT n]" and
+// "DESCEND index [LTE pivot] [GT pivot] [LIMIT n]". An empty index is ordered
+// by the keys. The reply is an array of keys and values.
+func cmdScanIndex(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	desc := strings.ToLower(args[0]) == "descend"
+	start, stop := "gte", "lt"
+	if desc {
+		start, stop = "lte", "gt"
+	}
+	var pstart, pstop *string
+	c := &collector{limit: -1}
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			w.writeError(errSyntax)
+			return
+		}
+		switch strings.ToLower(args[i]) {
+		case start:
+			pstart = &args[i+1]
+		case stop:
+			pstop = &args[i+1]
+		case "limit":
+			var ok bool
+			if c.limit, ok = parseLimit(args, i); !ok {
+				w.writeError(errSyntax)
+				return
+			}
+		default:
+			w.writeError(errSyntax)
+			return
+		}
+	}
+	var err error
+	index := args[1]
+	switch {
+	case !desc && pstart != nil && pstop != nil:
+		err = tx.AscendRange(index, *pstart, *pstop, c.iter)
+	case !desc && pstart != nil:
+		err = tx.AscendGreaterOrEqual(index, *pstart, c.iter)
+	case !desc && pstop != nil:
+		err = tx.AscendLessThan(index, *pstop, c.iter)
+	case !desc:
+		err = tx.Ascend(index, c.iter)
+	case pstart != nil && pstop != nil:
+		err = tx.DescendRange(index, *pstart, *pstop, c.iter)
+	case pstart != nil:
+		err = tx.DescendLessOrEqual(index, *pstart, c.iter)
+	case pstop != nil:
+		err = tx.DescendGreaterThan(index, *pstop, c.iter)
+	default:
+		err = tx.Descend(index, c.iter)
+	}
+	if err != nil {
+		w.writeError("ERR " + err.Error())
+		return
+	}
+	w.writeArray(c.items)
+}
+
+// cmdIntersects handles "INTERSECTS index bounds [LIMIT n]". The reply is an
+// array of keys and values.
+func cmdIntersects(s *Server, tx *buntdb.Tx, args []string, w *writer) {
+	c := &collector{limit: -1}
+	if len(args) > 3 {
+		var ok bool
+		if c.limit, ok = parseLimit(args, 3); !ok {
+			w.writeError(errSyntax)
+			return
+		}
+	}
+	if err := tx.Intersects(args[1], args[2], c.iter); err != nil {
+		w.writeError("ERR " + err.Error())
+		return
+	}
+	w.writeArray(c.items)
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// client is a minimal RESP client.
+type client struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func (c *client) do(args ...string) (interface{}, error) {
+	w := &writer{wr: bufio.NewWriter(c.conn)}
+	w.writeArray(args)
+	if err := w.wr.Flush(); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *client) read() (interface{}, error) {
+	line, err := readLine(c.rd)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		vals := make([]interface{}, n)
+		for i := range vals {
+			if vals[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return vals, nil
+	}
+	return nil, errProtocol
+}
+
+func testServer(t *testing.T) (*buntdb.DB, *Server, *client) {
+	db, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(db)
+	go func() { _ = s.Serve(ln) }()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, s, &client{conn: conn, rd: bufio.NewReader(conn)}
+}
+
+func TestServer(t *testing.T) {
+	db, s, c := testServer(t)
+	defer func() { _ = db.Close() }()
+	defer func() { _ = s.Close() }()
+	tests := []struct {
+		args   []string
+		expect string
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"SET", "user:1", "10"}, "OK"},
+		{[]string{"SET", "user:1", "11", "NX"}, "<nil>"},
+		{[]string{"SET", "user:2", "20", "XX"}, "<nil>"},
+		{[]string{"SET", "user:2", "30", "NX", "EX", "100"}, "OK"},
+		{[]string{"SET", "user:3", "5", "PX", "100000"}, "OK"},
+		{[]string{"SET", "user:4", "5", "EX"}, "ERR syntax error"},
+		{[]string{"GET", "user:1"}, "10"},
+		{[]string{"GET", "user:9"}, "<nil>"},
+		{[]string{"TTL", "user:2"}, "99..100"},
+		{[]string{"PTTL", "user:3"}, "99000..100000"},
+		{[]string{"TTL", "user:1"}, "-1"},
+		{[]string{"TTL", "user:9"}, "-2"},
+		{[]string{"INCR", "user:1"}, "11"},
+		{[]string{"KEYS", "user:*"}, "[user:1 user:2 user:3]"},
+		{[]string{"SCAN", "0", "MATCH", "user:*", "COUNT", "2"},
+			"[757365723a32 [user:1 user:2]]"},
+		{[]string{"SCAN", "757365723a32", "MATCH", "user:*", "COUNT", "2"},
+			"[0 [user:3]]"},
+		{[]string{"SCAN", "0", "MATCH", "user:*", "COUNT", "3"},
+			"[0 [user:1 user:2 user:3]]"},
+		{[]string{"SCAN", "nope"}, "ERR invalid cursor"},
+		{[]string{"CREATEINDEX", "vals", "user:*", "int"}, "OK"},
+		{[]string{"INDEXES"}, "[vals]"},
+		{[]string{"ASCEND", "vals"},
+			"[user:3 5 user:1 11 user:2 30]"},
+		{[]string{"ASCEND", "vals", "GTE", "6", "LIMIT", "1"},
+			"[user:1 11]"},
+		{[]string{"DESCEND", "vals", "LTE", "25", "GT", "6"},
+			"[user:1 11]"},
+		{[]string{"CREATESPATIALINDEX", "pts", "pt:*"}, "OK"},
+		{[]string{"SET", "pt:1", "[10 10]"}, "OK"},
+		{[]string{"SET", "pt:2", "[50 50]"}, "OK"},
+		{[]string{"INTERSECTS", "pts", "[0 0],[20 20]"}, "[pt:1 [10 10]]"},
+		{[]string{"DEL", "user:1", "user:9", "pt:1", "pt:2"}, "3"},
+		{[]string{"DROPINDEX", "vals"}, "OK"},
+		{[]string{"EXPIRE", "user:2", "1000"}, "1"},
+		{[]string{"PERSIST", "user:2"}, "1"},
+		{[]string{"PERSIST", "user:2"}, "0"},
+		{[]string{"DBSIZE"}, "2"},
+		{[]string{"NOPE"}, "ERR unknown command 'NOPE'"},
+		{[]string{"GET"}, "ERR wrong number of arguments for 'get' command"},
+		// transactions
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"SET", "a", "1"}, "QUEUED"},
+		{[]string{"INCRBY", "a", "2"}, "QUEUED"},
+		{[]string{"GET", "a"}, "QUEUED"},
+		{[]string{"EXEC"}, "[OK 3 3]"},
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"SET", "b", "1"}, "QUEUED"},
+		{[]string{"DISCARD"}, "OK"},
+		{[]string{"GET", "b"}, "<nil>"},
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"SET", "b"}, "ERR wrong number of arguments for 'set' command"},
+		{[]string{"EXEC"},
+			"EXECABORT Transaction discarded because of previous errors."},
+		{[]string{"EXEC"}, "ERR EXEC without MULTI"},
+	}
+	for i, test := range tests {
+		v, err := c.do(test.args...)
+		var res string
+		if err != nil {
+			res = err.Error()
+		} else {
+			res = fmt.Sprint(v)
+		}
+		if r := strings.Split(test.expect, ".."); len(r) == 2 {
+			// the reply is a number within a range
+			n, err := strconv.ParseInt(res, 10, 64)
+			lo, _ := strconv.ParseInt(r[0], 10, 64)
+			hi, _ := strconv.ParseInt(r[1], 10, 64)
+			if err == nil && n >= lo && n <= hi {
+				continue
+			}
+		}
+		if res != test.expect {
+			t.Fatalf("test %d %v: expecting '%v', got '%v'",
+				i, test.args, test.expect, res)
+		}
+	}
+}
+
+func TestServerExpired(t *testing.T) {
+	db, s, c := testServer(t)
+	defer func() { _ = db.Close() }()
+	defer func() { _ = s.Close() }()
+	for _, args := range [][]string{
+		{"SET", "a", "1"},
+		{"SET", "b", "2", "PX", "1"},
+		{"SET", "c", "3"},
+	} {
+		if _, err := c.do(args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	// the expired keys are skipped, even when they were not removed yet
+	for _, test := range []struct {
+		args   []string
+		expect string
+	}{
+		{[]string{"KEYS", "*"}, "[a c]"},
+		{[]string{"SCAN", "0", "COUNT", "1"}, "[61 [a]]"},
+		{[]string{"SCAN", "61", "COUNT", "1"}, "[0 [c]]"},
+	} {
+		v, err := c.do(test.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(v) != test.expect {
+			t.Fatalf("expecting '%v', got '%v'", test.expect, v)
+		}
+	}
+}
+
+func TestServerInline(t *testing.T) {
+	db, s, c := testServer(t)
+	defer func() { _ = db.Close() }()
+	defer func() { _ = s.Close() }()
+	// inline and pipelined commands
+	if _, err := c.conn.Write([]byte("SET a 1\r\nGET a\r\nQUIT\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"OK", "1", "OK"} {
+		v, err := c.read()
+		if err != nil || fmt.Sprint(v) != expect {
+			t.Fatalf("expecting '%v', got '%v'", expect, v)
+		}
+	}
+	_ = c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.read(); err == nil {
+		t.Fatal("expecting closed connection")
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	db, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(db)
+	done := make(chan error)
+	go func() { done <- s.Serve(ln) }()
+	c1, c2 := net.Pipe()
+	go s.ServeConn(c1)
+	c := &client{conn: c2, rd: bufio.NewReader(c2)}
+	if v, err := c.do("PING", "hi"); err != nil || v != "hi" {
+		t.Fatalf("expecting '%v', got '%v'", "hi", v)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Fatalf("expecting '%v', got '%v'", ErrServerClosed, err)
+	}
+	if _, err := c.do("PING"); err == nil {
+		t.Fatal("expecting closed connection")
+	}
+}